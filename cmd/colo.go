@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Colo (Cloudflare datacenter) policy for generate. GENERATE_MAX_PER_COLO
+// caps how many IPs one colo contributes, and GENERATE_REQUIRE_COLOS lists
+// colos that must each contribute at least one. IPs without a known colo
+// are never capped.
+
+const generatedBalancersPath = "generated-balancers.json"
+
+// lookupColos fills in the colo of results that have none, for the
+// built-in scan backends: each IP is asked for SCAN_COLO_URL (a
+// /cdn-cgi/trace page) and the colo= line is used, or else the suffix of
+// the CF-RAY header. SCAN_COLO=false skips the lookup.
+func lookupColos(results []ScanResult) {
+	if !envBool("SCAN_COLO", true) || len(results) == 0 {
+		return
+	}
+	u, err := url.Parse(envStr("SCAN_COLO_URL", "https://speed.cloudflare.com/cdn-cgi/trace"))
+	if err != nil || u.Host == "" {
+		stageLog("scan").Warn("invalid SCAN_COLO_URL; skipping colo lookup", "err", err)
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[bool]string{true: "443", false: "80"}[u.Scheme == "https"]
+	}
+	timeout := time.Duration(envInt("SCAN_COLO_TIMEOUT", 3)) * time.Second
+	sem := make(chan struct{}, max(envInt("SCAN_COLO_THREADS", 50), 1))
+	var wg sync.WaitGroup
+	for i := range results {
+		if results[i].Colo != "" {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *ScanResult) {
+			defer func() { <-sem; wg.Done() }()
+			r.Colo = traceColo(u, net.JoinHostPort(r.IP, port), timeout)
+		}(&results[i])
+	}
+	wg.Wait()
+	found := 0
+	for _, r := range results {
+		if r.Colo != "" {
+			found++
+		}
+	}
+	stageLog("scan").Info("colo lookup", "ips", len(results), "with_colo", found)
+}
+
+// traceColo requests u from the edge at addr and returns its colo, or "".
+func traceColo(u *url.URL, addr string, timeout time.Duration) string {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	for _, line := range strings.Split(string(body), "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "colo="); ok && v != "" {
+			return strings.ToUpper(v)
+		}
+	}
+	// CF-RAY looks like 7bd32409eda7b020-SJC.
+	if ray := resp.Header.Get("CF-RAY"); strings.Contains(ray, "-") {
+		return strings.ToUpper(ray[strings.LastIndex(ray, "-")+1:])
+	}
+	return ""
+}
+
+// warnWithoutColos warns when a colo setting is in use but no IP has a
+// colo, since those settings then silently do nothing.
+func warnWithoutColos(ips []string, colos map[string]string, configs []outboundTemplate) {
+	var settings []string
+	if envInt("GENERATE_MAX_PER_COLO", 0) > 0 {
+		settings = append(settings, "GENERATE_MAX_PER_COLO")
+	}
+	if envBool("GENERATE_COLO_TAG", false) {
+		settings = append(settings, "GENERATE_COLO_TAG")
+	}
+	if generateBalancers() {
+		settings = append(settings, "GENERATE_BALANCERS")
+	}
+	for _, t := range configs {
+		if len(t.Meta.Colos) > 0 {
+			settings = append(settings, t.File+" meta.colos")
+		}
+	}
+	if len(settings) == 0 || len(ips) == 0 {
+		return
+	}
+	for _, ip := range ips {
+		if colos[ip] != "" {
+			return
+		}
+	}
+	stageLog("generate").Warn("no scanned IP has a colo; colo settings have no effect (check SCAN_COLO)", "settings", strings.Join(settings, ", "))
+}
+
+// applyColoPolicy selects IPs in order under the colo policy, up to limit
+// (0 = all). Each required colo's best IP is taken before the rest.
+func applyColoPolicy(ips []string, colos map[string]string, limit int) ([]string, error) {
+	maxPer := envInt("GENERATE_MAX_PER_COLO", 0)
+	var required []string
+	for _, c := range strings.Split(os.Getenv("GENERATE_REQUIRE_COLOS"), ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			required = append(required, c)
+		}
+	}
+	if maxPer <= 0 && len(required) == 0 && limit <= 0 {
+		return ips, nil
+	}
+
+	picked := map[string]bool{}
+	perColo := map[string]int{}
+	n := 0
+	for _, c := range required {
+		found := false
+		for _, ip := range ips {
+			if colos[ip] == c && !picked[ip] {
+				picked[ip], found = true, true
+				perColo[c]++
+				n++
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no scanned IP in required colo %s", c)
+		}
+	}
+	for _, ip := range ips {
+		if limit > 0 && n >= limit {
+			break
+		}
+		c := colos[ip]
+		if picked[ip] || (c != "" && maxPer > 0 && perColo[c] >= maxPer) {
+			continue
+		}
+		picked[ip] = true
+		perColo[c]++
+		n++
+	}
+
+	var out []string
+	for _, ip := range ips {
+		if picked[ip] {
+			out = append(out, ip)
+			delete(picked, ip)
+		}
+	}
+	return out, nil
+}
+
+// generateBalancers reports whether GENERATE_BALANCERS asks for one
+// balancer per colo, which also puts the colo in every tag.
+func generateBalancers() bool {
+	return envBool("GENERATE_BALANCERS", false)
+}
+
+// coloBalancers builds one Xray routing balancer per colo of ips, tagged
+// {prefix}balancer-{colo}. Selectors are tag prefixes, so they rely on the
+// colo being in the outbound tags and cover only the default tag scheme.
+func coloBalancers(ips []string, colos map[string]string, configs []outboundTemplate) []map[string]interface{} {
+	prefix := outboundPrefix()
+	var ids []string
+	for _, t := range configs {
+		if t.Meta.Tag == "" && !slices.Contains(ids, t.id()) {
+			ids = append(ids, t.id())
+		}
+	}
+	var names []string
+	for _, ip := range ips {
+		if c := colos[ip]; c != "" && !slices.Contains(names, c) {
+			names = append(names, c)
+		}
+	}
+	sort.Strings(names)
+
+	balancers := []map[string]interface{}{}
+	for _, c := range names {
+		var sel []string
+		for _, id := range ids {
+			sel = append(sel, prefix+id+"-"+c+"-")
+		}
+		b := map[string]interface{}{"tag": prefix + "balancer-" + c, "selector": sel}
+		if strategy := os.Getenv("GENERATE_BALANCER_STRATEGY"); strategy != "" {
+			b["strategy"] = map[string]interface{}{"type": strategy}
+		}
+		balancers = append(balancers, b)
+	}
+	return balancers
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// run-cron keeps going when a cycle fails. After consecutive failures the
+// next cycle waits interval * 2^(failures-1), up to CRON_BACKOFF_MAX
+// minutes. After CRON_CIRCUIT_FAILURES failures in a row the circuit opens:
+// cycles run at the normal interval and still scan and generate but skip
+// update, so a broken panel is not hammered. Once CRON_CIRCUIT_COOLDOWN
+// minutes have passed since it opened, the next cycle is half-open and
+// updates again; success closes the circuit, failure reopens it.
+// STATUS_ADDR serves the state as JSON on /status.
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// cronStatus is the state of run-cron, as served on /status.
+type cronStatus struct {
+	Circuit  string    `json:"circuit"`
+	Failures int       `json:"failures"` // failed cycles in a row
+	OpenedAt time.Time `json:"opened_at,omitzero"`
+	Running  bool      `json:"running"`
+
+	LastRunID  string    `json:"last_run_id,omitempty"`
+	LastStatus string    `json:"last_status,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastEnd    time.Time `json:"last_end,omitzero"`
+	NextRun    time.Time `json:"next_run,omitzero"`
+}
+
+type cronPolicy struct {
+	interval   time.Duration
+	backoffMax time.Duration
+	threshold  int
+	cooldown   time.Duration
+	now        func() time.Time
+
+	mu     sync.Mutex
+	status cronStatus
+}
+
+func newCronPolicy(interval time.Duration) *cronPolicy {
+	return &cronPolicy{
+		interval:   interval,
+		backoffMax: max(time.Duration(envInt("CRON_BACKOFF_MAX", 360))*time.Minute, interval),
+		threshold:  envInt("CRON_CIRCUIT_FAILURES", 5),
+		cooldown:   time.Duration(envInt("CRON_CIRCUIT_COOLDOWN", 120)) * time.Minute,
+		now:        time.Now,
+		status:     cronStatus{Circuit: circuitClosed},
+	}
+}
+
+// beginCycle returns the circuit state the next cycle runs with, moving an
+// open circuit to half-open once the cooldown is over.
+func (p *cronPolicy) beginCycle() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &p.status
+	if s.Circuit == circuitOpen && p.now().Sub(s.OpenedAt) >= p.cooldown {
+		s.Circuit = circuitHalfOpen
+		stageLog("run-cron").Info("circuit half-open; trying panel update")
+	}
+	s.Running = true
+	return s.Circuit
+}
+
+// endCycle records the outcome of a cycle and returns how long to wait
+// before the next one.
+func (p *cronPolicy) endCycle(m *runManifest, err error) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &p.status
+	log := stageLog("run-cron")
+	now := p.now()
+	s.Running, s.LastEnd, s.LastRunID, s.LastStatus, s.LastError = false, now.UTC(), "", "ok", ""
+	if m != nil {
+		s.LastRunID = m.ID
+	}
+	if err != nil {
+		s.Failures++
+		s.LastStatus, s.LastError = "failed", err.Error()
+		if s.Circuit == circuitHalfOpen || (s.Circuit == circuitClosed && s.Failures >= p.threshold) {
+			s.Circuit, s.OpenedAt = circuitOpen, now.UTC()
+			log.Warn("circuit open; skipping panel updates", "failures", s.Failures, "retry_after", now.Add(p.cooldown).Format(time.RFC3339))
+		}
+	} else if s.Circuit != circuitOpen {
+		// Only a cycle that reached the panel ends the failure streak.
+		s.Failures = 0
+		if s.Circuit == circuitHalfOpen {
+			s.Circuit, s.OpenedAt = circuitClosed, time.Time{}
+			log.Info("circuit closed")
+		}
+	}
+	delay := p.delay()
+	s.NextRun = now.Add(delay).UTC()
+	if err != nil {
+		log.Warn("cycle failed", "err", err, "failures", s.Failures, "circuit", s.Circuit, "next", s.NextRun.Format(time.RFC3339))
+	} else {
+		log.Info("cycle completed", "circuit", s.Circuit, "next", s.NextRun.Format(time.RFC3339))
+	}
+	return delay
+}
+
+// delay backs off exponentially with the number of failures in a row while
+// the circuit is closed. An open circuit already spares the panel, so its
+// cycles keep the interval and the cooldown decides when update is retried.
+func (p *cronPolicy) delay() time.Duration {
+	d := p.interval
+	if p.status.Circuit != circuitClosed {
+		return d
+	}
+	for i := 1; i < p.status.Failures && d < p.backoffMax; i++ {
+		d *= 2
+	}
+	return min(d, p.backoffMax)
+}
+
+func (p *cronPolicy) snapshot() cronStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *cronPolicy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.snapshot())
+}
+
+// serveStatus listens on addr and serves the policy state on /status in the
+// background. Listening happens up front so a bad address fails run-cron.
+func serveStatus(addr string, p *cronPolicy) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("STATUS_ADDR: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /status", p)
+	go http.Serve(ln, mux)
+	stageLog("run-cron").Info("serving status", "addr", ln.Addr().String())
+	return nil
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCronPolicyBackoffAndCircuit(t *testing.T) {
+	t.Setenv("CRON_BACKOFF_MAX", "90")
+	t.Setenv("CRON_CIRCUIT_FAILURES", "3")
+	t.Setenv("CRON_CIRCUIT_COOLDOWN", "150")
+	p := newCronPolicy(time.Hour)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	fail := errors.New("update: panel down")
+
+	// cycle runs one cycle like run-cron does and moves the clock on by the
+	// delay it returns.
+	cycle := func(id string, err error) (string, time.Duration) {
+		circuit := p.beginCycle()
+		d := p.endCycle(&runManifest{ID: id, Circuit: circuit}, err)
+		now = now.Add(d)
+		return circuit, d
+	}
+
+	for i, want := range []struct {
+		err     error
+		circuit string
+		delay   time.Duration
+	}{
+		// Closed: failures back off 1h, then the 1h30m cap; the third opens
+		// the circuit.
+		{fail, circuitClosed, time.Hour},
+		{fail, circuitClosed, 90 * time.Minute},
+		{fail, circuitClosed, time.Hour},
+		// Open: cycles skip update at the interval until the cooldown is over.
+		{nil, circuitOpen, time.Hour},
+		{fail, circuitOpen, time.Hour},
+		// Half-open: the failed probe reopens the circuit for another cooldown.
+		{fail, circuitHalfOpen, time.Hour},
+		{nil, circuitOpen, time.Hour},
+		{nil, circuitOpen, time.Hour},
+		// Half-open success closes it.
+		{nil, circuitHalfOpen, time.Hour},
+		{nil, circuitClosed, time.Hour},
+	} {
+		circuit, d := cycle(fmt.Sprint("r", i), want.err)
+		if circuit != want.circuit || d != want.delay {
+			t.Errorf("cycle %d ran %s and waits %s, want %s and %s", i, circuit, d, want.circuit, want.delay)
+		}
+		if i == 5 {
+			if s := p.snapshot(); s.Circuit != circuitOpen || s.Failures != 5 || s.LastError != fail.Error() {
+				t.Errorf("status after failed probe = %+v", s)
+			}
+		}
+	}
+	if s := p.snapshot(); s.Circuit != circuitClosed || s.Failures != 0 || s.LastRunID != "r9" || !s.OpenedAt.IsZero() {
+		t.Errorf("status after recovery = %+v", s)
+	}
+}
+
+func TestCronPolicyStatus(t *testing.T) {
+	p := newCronPolicy(time.Hour)
+	p.beginCycle()
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var s cronStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if s.Circuit != circuitClosed || !s.Running {
+		t.Errorf("status = %s", rec.Body)
+	}
+}
@@ -0,0 +1,48 @@
+package cmd
+
+// With GENERATE_FRAGMENT, generate also emits one shared Xray freedom
+// outbound that fragments the TLS ClientHello, and chains every generated
+// outbound through it with streamSettings.sockopt.dialerProxy. Its tag
+// carries the outbound prefix, so update replaces it with the others.
+
+// fragmentEnabled reports whether GENERATE_FRAGMENT asks for the helper.
+func fragmentEnabled() bool {
+	return envBool("GENERATE_FRAGMENT", false)
+}
+
+func fragmentTag() string {
+	return outboundPrefix() + "fragment"
+}
+
+// fragmentOutbound builds the helper outbound from GENERATE_FRAGMENT_*.
+func fragmentOutbound() map[string]interface{} {
+	return map[string]interface{}{
+		"tag":      fragmentTag(),
+		"protocol": "freedom",
+		"settings": map[string]interface{}{
+			"fragment": map[string]interface{}{
+				"packets":  envStr("GENERATE_FRAGMENT_PACKETS", "tlshello"),
+				"length":   envStr("GENERATE_FRAGMENT_LENGTH", "100-200"),
+				"interval": envStr("GENERATE_FRAGMENT_INTERVAL", "10-20"),
+			},
+		},
+	}
+}
+
+// setDialerProxy routes ob through the fragment helper, unless its
+// template already chains it through another outbound.
+func setDialerProxy(ob map[string]interface{}) {
+	ss, _ := ob["streamSettings"].(map[string]interface{})
+	if ss == nil {
+		ss = map[string]interface{}{}
+		ob["streamSettings"] = ss
+	}
+	sockopt, _ := ss["sockopt"].(map[string]interface{})
+	if sockopt == nil {
+		sockopt = map[string]interface{}{}
+		ss["sockopt"] = sockopt
+	}
+	if p, _ := sockopt["dialerProxy"].(string); p == "" {
+		sockopt["dialerProxy"] = fragmentTag()
+	}
+}
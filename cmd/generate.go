@@ -1,11 +1,13 @@
 package cmd
 
 import (
-	"encoding/csv"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net/netip"
 	"os"
-	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -22,83 +24,235 @@ func init() {
 }
 
 func runGenerate(cmd *cobra.Command, args []string) error {
-	ips, err := readIPsFromCSV("ip-scan-result.csv")
+	ips, colos, failed, err := readIPsFromCSV(scanOutputPath())
 	if err != nil {
 		return err
 	}
-	configs, err := readConfigs("configs")
+	limit := 0
+	// GENERATE_RANK=score picks the same number of IPs by long-term score
+	// from the history database instead of the latest scan alone.
+	if strings.EqualFold(os.Getenv("GENERATE_RANK"), "score") {
+		scores, err := rankedIPsFromHistory()
+		if err != nil {
+			return err
+		}
+		limit, ips = len(ips), nil
+		for _, s := range scores {
+			ips = append(ips, s.IP)
+			if colos[s.IP] == "" && s.Colo != "" {
+				colos[s.IP] = s.Colo
+			}
+		}
+	}
+	if ips, err = applyIPFamilyPolicy(ips); err != nil {
+		return err
+	}
+	if ips, err = applyColoPolicy(ips, colos, limit); err != nil {
+		return err
+	}
+	configs, err := readConfigs(configsDir())
 	if err != nil {
 		return err
 	}
-	var outbounds []map[string]interface{}
+	warnWithoutColos(ips, colos, configs)
+	balancers := generateBalancers()
+	coloTags := balancers || envBool("GENERATE_COLO_TAG", false)
+	var (
+		outbounds []map[string]interface{}
+		owners    []string // template file of each outbound
+	)
+	used := map[string]map[string]bool{} // template file -> IPs it was expanded with
 	for _, ip := range ips {
-		for _, cfg := range configs {
-			ob, err := cloneAndSetAddress(cfg, ip)
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("invalid IP %q in scan result", ip)
+		}
+		for _, t := range configs {
+			if !t.Meta.accepts(addr, colos[ip]) || failed[ip][t.variant()] {
+				continue
+			}
+			if used[t.File] == nil {
+				used[t.File] = map[string]bool{}
+			}
+			if n := t.Meta.MaxIPs; n > 0 && !used[t.File][ip] && len(used[t.File]) >= n {
+				continue
+			}
+			used[t.File][ip] = true
+			tagColo := colos[ip]
+			if !coloTags && t.Meta.Tag == "" {
+				tagColo = ""
+			}
+			ob, err := cloneAndSetAddress(t, ip, tagColo)
 			if err != nil {
 				return err
 			}
+			if fragmentEnabled() {
+				setDialerProxy(ob)
+			}
 			outbounds = append(outbounds, ob)
+			owners = append(owners, t.File)
 		}
 	}
-	f, err := os.Create("generated-outbounds.json")
+	if fragmentEnabled() && len(outbounds) > 0 {
+		outbounds = append(outbounds, fragmentOutbound())
+	}
+	if err := checkDuplicateTags(outbounds, owners); err != nil {
+		return err
+	}
+	data, err := encodeJSON(outbounds)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetEscapeHTML(false)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(outbounds); err != nil {
+	if err := writeFileAtomic(workPath(generatedOutboundsPath), data); err != nil {
+		return err
+	}
+	deployed := usedIPs(used)
+	noteIPs(len(deployed))
+	noteTemplates(configsDir())
+	noteOutbounds(data, len(outbounds), deployed)
+	if balancers {
+		if err := writeJSONFile(workPath(generatedBalancersPath), coloBalancers(ips, colos, configs)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(workPath(generatedBalancersPath)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	fmt.Println("[generate] completed")
+	stageLog("generate").Info("wrote outbounds", "outbounds", len(outbounds), "ips", len(deployed))
 	return nil
 }
 
-func readIPsFromCSV(path string) ([]string, error) {
-	f, err := os.Open(path)
+// writeJSONFile writes v as indented JSON via writeFileAtomic, so update
+// never sees a half-written file.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := encodeJSON(v)
 	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	r := csv.NewReader(f)
-	rows, err := r.ReadAll()
+	return buf.Bytes(), nil
+}
+
+// usedIPs returns the distinct IPs across templates' used sets, sorted.
+func usedIPs(used map[string]map[string]bool) []string {
+	all := map[string]bool{}
+	for _, ips := range used {
+		for ip := range ips {
+			all[ip] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(all))
+}
+
+// readIPsFromCSV returns the IPs of a scan CSV in order, their colo, and
+// the template variants verify failed each of them for.
+func readIPsFromCSV(path string) ([]string, map[string]string, map[string]map[string]bool, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	results, err := parseScanCSV(data)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 	var ips []string
-	for i, row := range rows {
-		if i == 0 && len(row) > 0 && row[0] == "IP Address" {
-			continue
+	colos := map[string]string{}
+	failed := map[string]map[string]bool{}
+	for _, r := range results {
+		ips = append(ips, r.IP)
+		if r.Colo != "" {
+			colos[r.IP] = strings.ToUpper(r.Colo)
 		}
-		if len(row) > 0 && row[0] != "" {
-			ips = append(ips, row[0])
+		for _, v := range r.FailedTemplates {
+			if failed[r.IP] == nil {
+				failed[r.IP] = map[string]bool{}
+			}
+			failed[r.IP][v] = true
 		}
 	}
-	return ips, nil
+	return ips, colos, failed, nil
 }
 
-func readConfigs(dir string) ([]map[string]interface{}, error) {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, err
+// checkDuplicateTags fails when two outbounds share a tag, since Xray would
+// silently keep only one. owners names the template of each outbound;
+// outbounds beyond it (helpers) are attributed to generate itself.
+func checkDuplicateTags(outbounds []map[string]interface{}, owners []string) error {
+	seen := map[string][]string{}
+	var order []string
+	for i, ob := range outbounds {
+		tag, _ := ob["tag"].(string)
+		owner := "generate"
+		if i < len(owners) {
+			owner = owners[i]
+		}
+		if _, ok := seen[tag]; !ok {
+			order = append(order, tag)
+		}
+		seen[tag] = append(seen[tag], owner)
 	}
-	var configs []map[string]interface{}
-	for _, e := range entries {
-		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
-			continue
+	var conflicts []string
+	for _, tag := range order {
+		if files := seen[tag]; len(files) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("%s (from %s)", tag, strings.Join(files, ", ")))
 		}
-		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("duplicate outbound tags; give the templates distinct meta ids or tag patterns:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+	return nil
+}
+
+// applyIPFamilyPolicy filters ips by GENERATE_IP_FAMILY: "v4" (default),
+// "v6" or "mixed"; IPv6 is opt-in like scanning ipv6.txt. GENERATE_V4_MAX and GENERATE_V6_MAX cap how many IPs
+// of each family are kept (0 = no cap); order is preserved.
+func applyIPFamilyPolicy(ips []string) ([]string, error) {
+	family := strings.ToLower(envStr("GENERATE_IP_FAMILY", "v4"))
+	v4Max, v6Max := envInt("GENERATE_V4_MAX", 0), envInt("GENERATE_V6_MAX", 0)
+	switch family {
+	case "mixed":
+	case "v4":
+		v6Max = -1
+	case "v6":
+		v4Max = -1
+	default:
+		return nil, fmt.Errorf("GENERATE_IP_FAMILY must be v4, v6 or mixed, got %q", family)
+	}
+	var out []string
+	var v4, v6 int
+	for _, ip := range ips {
+		a, err := netip.ParseAddr(ip)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid IP %q in scan result", ip)
+		}
+		n, limit := &v4, v4Max
+		if !a.Unmap().Is4() {
+			n, limit = &v6, v6Max
 		}
-		var cfg map[string]interface{}
-		if err := json.Unmarshal(data, &cfg); err != nil {
-			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		if limit < 0 || (limit > 0 && *n >= limit) {
+			continue
 		}
-		configs = append(configs, cfg)
+		*n++
+		out = append(out, ip)
+	}
+	if len(out) == 0 && len(ips) > 0 {
+		return nil, fmt.Errorf("no IPs left after GENERATE_IP_FAMILY=%s (IPv6 needs GENERATE_IP_FAMILY=v6 or mixed)", family)
 	}
-	return configs, nil
+	return out, nil
+}
+
+// tagIP renders an address for use in an outbound tag: IPv6 colons become
+// dashes, since some tooling splits tags on ':'.
+func tagIP(ip string) string {
+	return strings.ReplaceAll(ip, ":", "-")
 }
 
 func outboundPrefix() string {
@@ -109,38 +263,28 @@ func outboundPrefix() string {
 	return p
 }
 
-func cloneAndSetAddress(cfg map[string]interface{}, ip string) (map[string]interface{}, error) {
-	data, err := json.Marshal(cfg)
+// cloneAndSetAddress copies an outbound template with its address set to
+// ip. The tag is {prefix}{id}-{ip}, or {prefix}{id}-{colo}-{ip} when colo
+// is given, followed by the template's matrix port and SNI; a
+// meta tag pattern replaces this scheme.
+func cloneAndSetAddress(t outboundTemplate, ip, colo string) (map[string]interface{}, error) {
+	out, err := deepCopyMap(t.Config)
 	if err != nil {
 		return nil, err
 	}
-	var out map[string]interface{}
-	if err := json.Unmarshal(data, &out); err != nil {
-		return nil, err
+	label := tagIP(ip)
+	if colo != "" {
+		label = colo + "-" + label
 	}
-	prefix := outboundPrefix()
 	protocol, _ := out["protocol"].(string)
 	switch protocol {
-	case "trojan":
-		if settings, ok := out["settings"].(map[string]interface{}); ok {
-			if servers, ok := settings["servers"].([]interface{}); ok && len(servers) > 0 {
-				if s, ok := servers[0].(map[string]interface{}); ok {
-					s["address"] = ip
-				}
-			}
-		}
-		out["tag"] = prefix + "trojan-" + ip
-	case "vless":
-		if settings, ok := out["settings"].(map[string]interface{}); ok {
-			if vnext, ok := settings["vnext"].([]interface{}); ok {
-				for _, v := range vnext {
-					if m, ok := v.(map[string]interface{}); ok {
-						m["address"] = ip
-					}
-				}
-			}
+	case "trojan", "vless":
+		setServerField(out, "address", ip)
+		if t.Meta.Tag != "" {
+			out["tag"] = templateTag(t, protocol, ip, colo)
+		} else {
+			out["tag"] = outboundPrefix() + t.id() + "-" + label + t.tagSuffix()
 		}
-		out["tag"] = prefix + "vless-" + ip
 	}
 	return out, nil
 }
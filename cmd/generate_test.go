@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyIPFamilyPolicy(t *testing.T) {
+	ips := []string{"1.1.1.1", "2606:4700::1", "1.0.0.1", "2606:4700::2", "104.16.0.1"}
+	tests := []struct {
+		family, v4Max, v6Max string
+		want                 string
+	}{
+		{"", "", "", "1.1.1.1,1.0.0.1,104.16.0.1"},
+		{"mixed", "", "", "1.1.1.1,2606:4700::1,1.0.0.1,2606:4700::2,104.16.0.1"},
+		{"v4", "", "", "1.1.1.1,1.0.0.1,104.16.0.1"},
+		{"v6", "", "", "2606:4700::1,2606:4700::2"},
+		{"mixed", "2", "1", "1.1.1.1,2606:4700::1,1.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Setenv("GENERATE_IP_FAMILY", tt.family)
+		t.Setenv("GENERATE_V4_MAX", tt.v4Max)
+		t.Setenv("GENERATE_V6_MAX", tt.v6Max)
+		got, err := applyIPFamilyPolicy(ips)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s v4=%s v6=%s: got %v, want %s", tt.family, tt.v4Max, tt.v6Max, got, tt.want)
+		}
+	}
+
+	t.Setenv("GENERATE_IP_FAMILY", "v6")
+	t.Setenv("GENERATE_V4_MAX", "")
+	t.Setenv("GENERATE_V6_MAX", "")
+	if _, err := applyIPFamilyPolicy([]string{"1.1.1.1"}); err == nil {
+		t.Error("expected an error when the policy leaves no IPs")
+	}
+}
+
+func TestCloneAndSetAddressSanitizesIPv6Tag(t *testing.T) {
+	t.Setenv("OUTBOUND_PREFIX", "")
+	cfg := map[string]interface{}{
+		"protocol": "vless",
+		"settings": map[string]interface{}{"vnext": []interface{}{map[string]interface{}{"address": "x"}}},
+	}
+	ob, err := cloneAndSetAddress(outboundTemplate{Config: cfg}, "2606:4700::1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ob["tag"] != "cf-clean-vless-2606-4700--1" {
+		t.Errorf("tag = %v", ob["tag"])
+	}
+	vnext := ob["settings"].(map[string]interface{})["vnext"].([]interface{})
+	if addr := vnext[0].(map[string]interface{})["address"]; addr != "2606:4700::1" {
+		t.Errorf("address = %v, want the unsanitized IP", addr)
+	}
+}
+
+func TestApplyColoPolicy(t *testing.T) {
+	ips := []string{"1.0.0.1", "1.0.0.2", "1.0.0.3", "1.0.0.4", "1.0.0.5", "1.0.0.6"}
+	colos := map[string]string{"1.0.0.1": "FRA", "1.0.0.2": "FRA", "1.0.0.3": "FRA", "1.0.0.4": "AMS", "1.0.0.6": "LHR"}
+	tests := []struct {
+		maxPer, require string
+		limit           int
+		want            string
+	}{
+		{"", "", 0, "1.0.0.1,1.0.0.2,1.0.0.3,1.0.0.4,1.0.0.5,1.0.0.6"},
+		{"1", "", 0, "1.0.0.1,1.0.0.4,1.0.0.5,1.0.0.6"},
+		{"2", "", 3, "1.0.0.1,1.0.0.2,1.0.0.4"},
+		{"", "lhr", 2, "1.0.0.1,1.0.0.6"},
+	}
+	for _, tt := range tests {
+		t.Setenv("GENERATE_MAX_PER_COLO", tt.maxPer)
+		t.Setenv("GENERATE_REQUIRE_COLOS", tt.require)
+		got, err := applyColoPolicy(ips, colos, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("max=%s require=%s limit=%d: got %v, want %s", tt.maxPer, tt.require, tt.limit, got, tt.want)
+		}
+	}
+
+	t.Setenv("GENERATE_REQUIRE_COLOS", "SIN")
+	if _, err := applyColoPolicy(ips, colos, 0); err == nil {
+		t.Error("expected an error for a required colo with no IPs")
+	}
+}
+
+func TestRunGenerateColoTagsAndBalancers(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("configs", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("configs", "trojan.json"), []byte(trojanTemplate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SCAN_O", "result.csv")
+	err := writeScanCSV(scanOutputPath(), []ScanResult{
+		{IP: "1.0.0.1", Colo: "FRA"}, {IP: "1.0.0.2", Colo: "fra"}, {IP: "1.0.0.3", Colo: "AMS"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OUTBOUND_PREFIX", "")
+	t.Setenv("GENERATE_BALANCERS", "true")
+	t.Setenv("GENERATE_MAX_PER_COLO", "1")
+
+	if err := runGenerate(generateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var outbounds, balancers []interface{}
+	for path, v := range map[string]*[]interface{}{generatedOutboundsPath: &outbounds, generatedBalancersPath: &balancers} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := strings.Join(outboundTags(outbounds), ","), "cf-clean-trojan-FRA-1.0.0.1,cf-clean-trojan-AMS-1.0.0.3"; got != want {
+		t.Errorf("outbounds = %s, want %s", got, want)
+	}
+	if got, want := strings.Join(outboundTags(balancers), ","), "cf-clean-balancer-AMS,cf-clean-balancer-FRA"; got != want {
+		t.Errorf("balancers = %s, want %s", got, want)
+	}
+}
+
+func TestRunGenerateFragmentHelper(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("configs", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("configs", "trojan.json"), []byte(trojanTemplate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SCAN_O", "result.csv")
+	if err := writeScanCSV(scanOutputPath(), []ScanResult{{IP: "1.0.0.1"}, {IP: "1.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OUTBOUND_PREFIX", "")
+	t.Setenv("GENERATE_FRAGMENT", "true")
+	t.Setenv("GENERATE_FRAGMENT_LENGTH", "10-20")
+
+	if err := runGenerate(generateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(generatedOutboundsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outbounds []interface{}
+	if err := json.Unmarshal(data, &outbounds); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(outboundTags(outbounds), ","), "cf-clean-trojan-1.0.0.1,cf-clean-trojan-1.0.0.2,cf-clean-fragment"; got != want {
+		t.Fatalf("outbounds = %s, want %s", got, want)
+	}
+	helper := outbounds[2].(map[string]interface{})
+	fragment := helper["settings"].(map[string]interface{})["fragment"].(map[string]interface{})
+	if helper["protocol"] != "freedom" || fragment["length"] != "10-20" || fragment["packets"] != "tlshello" {
+		t.Errorf("fragment helper = %v", helper)
+	}
+	if err := checkDialerProxies(outbounds); err != nil {
+		t.Error(err)
+	}
+	ss := outbounds[0].(map[string]interface{})["streamSettings"].(map[string]interface{})
+	if p := ss["sockopt"].(map[string]interface{})["dialerProxy"]; p != "cf-clean-fragment" {
+		t.Errorf("dialerProxy = %v", p)
+	}
+	if err := checkDialerProxies(outbounds[:2]); err == nil {
+		t.Error("expected an error for a missing dialerProxy target")
+	}
+}
+
+func TestLookupColos(t *testing.T) {
+	trace := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fl=1\nh=speed.cloudflare.com\ncolo=fra\nhttp=http/1.1\n"))
+	}))
+	defer trace.Close()
+	ray := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("CF-RAY", "7bd32409eda7b020-SJC")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ray.Close()
+
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{trace.URL + "/cdn-cgi/trace", "FRA"},
+		{ray.URL + "/cdn-cgi/trace", "SJC"},
+	} {
+		// The URL's host only names the site; the request goes to each IP.
+		u, _ := url.Parse(tc.url)
+		t.Setenv("SCAN_COLO_URL", "http://speed.cloudflare.com:"+u.Port()+u.Path)
+		results := []ScanResult{{IP: "127.0.0.1"}, {IP: "127.0.0.2", Colo: "AMS"}}
+		lookupColos(results)
+		if results[0].Colo != tc.want || results[1].Colo != "AMS" {
+			t.Errorf("%s: colos = %q, %q; want %q, AMS", tc.url, results[0].Colo, results[1].Colo, tc.want)
+		}
+	}
+
+	t.Setenv("SCAN_COLO", "false")
+	results := []ScanResult{{IP: "127.0.0.1"}}
+	lookupColos(results)
+	if results[0].Colo != "" {
+		t.Errorf("SCAN_COLO=false still looked up %q", results[0].Colo)
+	}
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log lines go to stderr through log/slog, so command output (tables,
+// manifests) stays alone on stdout. LOG_FORMAT is text (default) or json,
+// LOG_LEVEL debug, info (default), warn or error. Every line of a run
+// carries its run_id, and lines of a stage its stage. Attributes and JSON
+// bodies are redacted: see sensitiveKey.
+
+var baseLogger = slog.Default()
+
+func init() {
+	l, err := newLogger(os.Stderr, envStr("LOG_FORMAT", "text"), envStr("LOG_LEVEL", "info"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	baseLogger = l
+}
+
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redactAttr}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("LOG_FORMAT must be text or json, got %q", format)
+}
+
+// stageLog returns the logger for a stage, tagged with the run in progress.
+func stageLog(stage string) *slog.Logger {
+	l := baseLogger.With("stage", stage)
+	if activeRun != nil {
+		l = l.With("run_id", activeRun.ID)
+	}
+	return l
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveKey reports whether values under key must not be logged:
+// credentials, cookies and the secrets of outbound templates (trojan
+// passwords, vless ids, reality keys).
+func sensitiveKey(key string) bool {
+	k := strings.ToLower(key)
+	switch k {
+	case "id", "uuid", "pass", "passwd", "privatekey", "shortid", "authorization":
+		return true
+	}
+	for _, s := range []string{"password", "secret", "cookie", "token"} {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	if a.Value.Kind() == slog.KindAny {
+		switch v := a.Value.Any().(type) {
+		case map[string]interface{}, []interface{}:
+			return slog.Any(a.Key, redactValue(v))
+		}
+	}
+	return a
+}
+
+// redactValue returns a copy of a decoded JSON value with sensitive keys
+// masked. Strings holding JSON objects (3x-ui nests xraySetting as one)
+// are redacted too.
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if sensitiveKey(k) {
+				out[k] = redacted
+			} else {
+				out[k] = redactValue(e)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = redactValue(e)
+		}
+		return out
+	case string:
+		if strings.HasPrefix(strings.TrimSpace(v), "{") {
+			var inner interface{}
+			if json.Unmarshal([]byte(v), &inner) == nil {
+				data, _ := json.Marshal(redactValue(inner))
+				return string(data)
+			}
+		}
+	}
+	return v
+}
+
+// redactBody renders a response body for logging: JSON with sensitive
+// fields masked, anything else cut to a short excerpt.
+func redactBody(body []byte) string {
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		data, _ := json.Marshal(redactValue(v))
+		return string(data)
+	}
+	const max = 200
+	if len(body) > max {
+		return string(body[:max]) + "..."
+	}
+	return string(body)
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLoggerJSONRedactsSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ob map[string]interface{}
+	if err := json.Unmarshal([]byte(trojanTemplate), &ob); err != nil {
+		t.Fatal(err)
+	}
+	l.With("stage", "update", "run_id", "r1").Debug("push",
+		"password", "hunter2", "Set-Cookie", "3x-ui=abc", "outbound", ob)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("not one JSON line: %v\n%s", err, buf.String())
+	}
+	if line["stage"] != "update" || line["run_id"] != "r1" || line["level"] != "DEBUG" {
+		t.Errorf("missing fields: %s", buf.String())
+	}
+	if line["password"] != redacted || line["Set-Cookie"] != redacted {
+		t.Errorf("credentials not redacted: %s", buf.String())
+	}
+	if strings.Contains(buf.String(), `"password":"pass"`) {
+		t.Errorf("template secret leaked: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "trojan") {
+		t.Errorf("outbound not logged: %s", buf.String())
+	}
+}
+
+func TestRedactBodyNestedConfig(t *testing.T) {
+	inner := `{"xraySetting":{"outbounds":[{"protocol":"vless","settings":{"vnext":[{"users":[{"id":"uuid-1"}]}]}}]}}`
+	body, _ := json.Marshal(map[string]interface{}{"success": true, "obj": inner})
+	got := redactBody(body)
+	if strings.Contains(got, "uuid-1") || !strings.Contains(got, "vless") {
+		t.Errorf("redactBody = %s", got)
+	}
+	if got := redactBody([]byte(strings.Repeat("x", 500))); len(got) > 210 {
+		t.Errorf("non-JSON body not truncated: %d bytes", len(got))
+	}
+}
+
+func TestNewLoggerRejectsUnknownSettings(t *testing.T) {
+	if _, err := newLogger(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("LOG_FORMAT=xml accepted")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "text", "loud"); err == nil {
+		t.Error("LOG_LEVEL=loud accepted")
+	}
+}
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Ptechgithub/CloudflareScanner/task"
+	"github.com/Ptechgithub/CloudflareScanner/utils"
+	"github.com/spf13/cobra"
+)
+
+// Every run writes a manifest to RUN_HISTORY_DIR (default runs/ in
+// WORK_DIR) linking the scan settings, the IP count after each stage, the
+// templates and generated outbounds by hash, and the panel push. The
+// newest RUN_HISTORY_KEEP manifests are kept.
+
+// runManifest describes one run.
+type runManifest struct {
+	ID     string    `json:"id"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Status string    `json:"status"` // ok or failed
+	Error  string    `json:"error,omitempty"`
+	// Circuit is run-cron's circuit breaker state; update is skipped when open.
+	Circuit string `json:"circuit,omitempty"`
+
+	Scan      map[string]interface{} `json:"scan"`
+	Stages    []stageRecord          `json:"stages"`
+	Templates map[string]string      `json:"templates,omitempty"` // file -> sha256
+	// Outbounds and OutboundsHash describe generated-outbounds.json.
+	Outbounds     int    `json:"outbounds"`
+	OutboundsHash string `json:"outbounds_hash,omitempty"`
+	// IPs are the distinct IPs the generated outbounds use.
+	IPs    []string    `json:"ips,omitempty"`
+	Panels []panelPush `json:"panels,omitempty"`
+}
+
+type stageRecord struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// IPs is how many IPs the stage left, for stages that handle IPs.
+	IPs   *int   `json:"ips,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// panelPush is the outcome of pushing outbounds to one panel.
+type panelPush struct {
+	URL       string `json:"url"`
+	Outbounds int    `json:"outbounds"`
+	Updated   bool   `json:"updated"`
+	Restart   string `json:"restart,omitempty"` // ok, failed, hot (applied via the Xray API) or skipped (no changes); empty if not reached
+	Error     string `json:"error,omitempty"`
+}
+
+// activeRun is the manifest of the run in progress; stages note their
+// results in it. It is nil when a stage runs on its own.
+var activeRun *runManifest
+
+func newRunManifest() *runManifest {
+	start := time.Now().UTC()
+	var b [3]byte
+	_, _ = rand.Read(b[:])
+	return &runManifest{
+		ID:    start.Format("20060102T150405Z") + "-" + hex.EncodeToString(b[:]),
+		Start: start,
+		Scan:  scanSettings(),
+	}
+}
+
+// scanSettings records the settings the scan stage runs with.
+func scanSettings() map[string]interface{} {
+	sources := os.Getenv("SCAN_SOURCES")
+	if sources == "" {
+		sources = firstNonEmpty(task.IPText, task.IPFile)
+	}
+	return map[string]interface{}{
+		"backend":        envStr("SCAN_BACKEND", "cloudflarescanner"),
+		"sources":        sources,
+		"exclude":        os.Getenv("SCAN_EXCLUDE"),
+		"sampler":        envStr("SCAN_SAMPLER", "random"),
+		"threads":        task.Routines,
+		"ping_times":     task.PingTimes,
+		"port":           task.TCPPort,
+		"httping":        task.Httping,
+		"colos":          task.HttpingCFColo,
+		"max_latency_ms": utils.InputMaxDelay.Milliseconds(),
+		"min_latency_ms": utils.InputMinDelay.Milliseconds(),
+		"max_loss_rate":  utils.InputMaxLossRate,
+		"min_speed_mbps": task.MinSpeed,
+		"download_test":  !task.Disable,
+		"test_all":       task.TestAll,
+	}
+}
+
+func (m *runManifest) beginStage(name string) {
+	m.Stages = append(m.Stages, stageRecord{Name: name, Start: time.Now().UTC()})
+}
+
+func (m *runManifest) endStage(err error) {
+	s := &m.Stages[len(m.Stages)-1]
+	s.End = time.Now().UTC()
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// finish completes the manifest and saves it.
+func (m *runManifest) finish(err error) error {
+	m.End = time.Now().UTC()
+	m.Status = "ok"
+	if err != nil {
+		m.Status, m.Error = "failed", err.Error()
+	}
+	dir := runHistoryDir()
+	if dir == "" {
+		return nil
+	}
+	data, jerr := json.MarshalIndent(m, "", "  ")
+	if jerr != nil {
+		return jerr
+	}
+	if werr := writeFileAtomic(filepath.Join(dir, m.ID+".json"), data); werr != nil {
+		return werr
+	}
+	return pruneRunHistory(dir, envInt("RUN_HISTORY_KEEP", 50))
+}
+
+// noteIPs records how many IPs the current stage left.
+func noteIPs(n int) {
+	if activeRun != nil && len(activeRun.Stages) > 0 {
+		activeRun.Stages[len(activeRun.Stages)-1].IPs = &n
+	}
+}
+
+// noteTemplates records the hash of every template file in dir.
+func noteTemplates(dir string) {
+	if activeRun == nil {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	activeRun.Templates = map[string]string{}
+	for _, f := range files {
+		if data, err := os.ReadFile(f); err == nil {
+			activeRun.Templates[filepath.Base(f)] = sha256Hex(data)
+		}
+	}
+}
+
+// noteOutbounds records the generated outbounds file and its IPs.
+func noteOutbounds(data []byte, n int, ips []string) {
+	if activeRun != nil {
+		activeRun.Outbounds, activeRun.OutboundsHash, activeRun.IPs = n, sha256Hex(data), ips
+	}
+}
+
+func notePanelPush(p panelPush) {
+	if activeRun != nil {
+		activeRun.Panels = append(activeRun.Panels, p)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// runHistoryDir is where manifests go, or "" when RUN_HISTORY_DIR is off.
+func runHistoryDir() string {
+	dir := envStr("RUN_HISTORY_DIR", "runs")
+	if strings.EqualFold(dir, "off") {
+		return ""
+	}
+	return workPath(dir)
+}
+
+// listRunManifests returns the manifest files in dir, newest first. IDs
+// start with the UTC start time, so names sort chronologically.
+func listRunManifests(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	return files, nil
+}
+
+func pruneRunHistory(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	files, err := listRunManifests(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files[min(keep, len(files)):] {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history [run-id]",
+	Short: "List past runs, or print the manifest of one",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := runHistoryDir()
+		if dir == "" {
+			return fmt.Errorf("RUN_HISTORY_DIR is off")
+		}
+		if len(args) == 1 {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.Base(args[0])+".json"))
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+		files, err := listRunManifests(dir)
+		if err != nil {
+			return err
+		}
+		n, _ := cmd.Flags().GetInt("top")
+		fmt.Printf("%-28s%-22s%-10s%-8s%-22s%-11s%s\n", "Run ID", "Start", "Duration", "Status", "IPs per stage", "Outbounds", "Panel")
+		for i, f := range files {
+			if n > 0 && i >= n {
+				break
+			}
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			var m runManifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				fmt.Printf("%-28s(unreadable: %v)\n", strings.TrimSuffix(filepath.Base(f), ".json"), err)
+				continue
+			}
+			fmt.Printf("%-28s%-22s%-10s%-8s%-22s%-11d%s\n", m.ID, m.Start.Local().Format("2006-01-02 15:04:05"),
+				m.End.Sub(m.Start).Round(time.Second), m.Status, stageIPs(m.Stages), m.Outbounds, panelSummary(m.Panels))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.Flags().IntP("top", "n", 20, "Number of runs to list (0 = all)")
+}
+
+// stageIPs renders the IP counts of the stages that have one, e.g. 120>40>40.
+func stageIPs(stages []stageRecord) string {
+	var counts []string
+	for _, s := range stages {
+		if s.IPs != nil {
+			counts = append(counts, fmt.Sprint(*s.IPs))
+		}
+	}
+	if len(counts) == 0 {
+		return "-"
+	}
+	return strings.Join(counts, ">")
+}
+
+func panelSummary(panels []panelPush) string {
+	if len(panels) == 0 {
+		return "-"
+	}
+	var parts []string
+	for _, p := range panels {
+		s := "updated"
+		switch {
+		case p.Error != "":
+			s = "failed"
+		case p.Restart == "ok":
+			s = "updated+restarted"
+		case p.Restart == "hot":
+			s = "updated+hot-applied"
+		case p.Restart == "skipped":
+			s = "unchanged"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ptechgithub/CloudflareScanner/task"
+	"github.com/Ptechgithub/CloudflareScanner/utils"
+)
+
+const nativeDialTimeout = time.Second
+
+// nativeScanner is a built-in TCPing scanner. It reads the same SCAN_*
+// settings as CloudflareScanner (threads, ping times, port, latency and loss
+// filters) plus the range sources, but does no HTTPing or download test.
+type nativeScanner struct {
+	probed []string
+}
+
+func (s *nativeScanner) Probed() []string { return s.probed }
+
+func (s *nativeScanner) Scan() ([]ScanResult, error) {
+	prefixes, err := resolveScanRanges()
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	if adaptiveSampling() {
+		ips, err = adaptiveSample(prefixes, envInt("SCAN_SAMPLE_BUDGET", 1000), envFloat("SCAN_EXPLORE", 0.2))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ips = sampleIPs(prefixes, task.TestAll)
+	}
+	s.probed = probedIPs(ips)
+	stageLog("scan").Info("native probe", "ips", len(ips), "port", task.TCPPort, "threads", task.Routines)
+
+	results := probeIPs(ips, task.TCPPort, task.PingTimes, task.Routines)
+	var kept []ScanResult
+	for _, r := range results {
+		if r.Latency > utils.InputMaxDelay || r.Latency < utils.InputMinDelay {
+			continue
+		}
+		if r.LossRate() > float64(utils.InputMaxLossRate) {
+			continue
+		}
+		kept = append(kept, r)
+	}
+	lookupColos(kept)
+	return kept, nil
+}
+
+// sampleIPs picks one random address per /24 (IPv4) and sampleIPv6's
+// picks per IPv6 prefix; with all set, every IPv4 address is returned.
+func sampleIPs(prefixes []netip.Prefix, all bool) []netip.Addr {
+	var ips []netip.Addr
+	for _, p := range prefixes {
+		if !p.Addr().Is4() {
+			ips = append(ips, sampleIPv6(p)...)
+			continue
+		}
+		sub := max(p.Bits(), 24)
+		for _, block := range splitPrefix(p, sub) {
+			if all {
+				for a := block.Addr(); block.Contains(a); a = a.Next() {
+					ips = append(ips, a)
+				}
+				continue
+			}
+			ips = append(ips, randomAddr(block))
+		}
+	}
+	return ips
+}
+
+// sampleIPv6 picks SCAN_V6_SAMPLES addresses from an IPv6 prefix. Testing
+// every address, or even every /64, of a /32 is impossible, so each sample
+// lands in a different random /48; SCAN_V6_STRATEGY chooses the interface
+// ID: "random" (default) or "low" (::1 to ::ff, which some edges prefer).
+func sampleIPv6(p netip.Prefix) []netip.Addr {
+	if p.Bits() == 128 {
+		return []netip.Addr{p.Addr()}
+	}
+	n := max(envInt("SCAN_V6_SAMPLES", 64), 1)
+	low := strings.EqualFold(os.Getenv("SCAN_V6_STRATEGY"), "low")
+	seen := map[netip.Addr]bool{}
+	var ips []netip.Addr
+	for tries := 0; len(ips) < n && tries < n*4; tries++ {
+		block := p
+		if p.Bits() < 48 {
+			block = subnetOf(randomAddr(p))
+		}
+		a := randomAddr(block)
+		if low {
+			b := a.As16()
+			host := netip.PrefixFrom(block.Addr(), max(block.Bits(), 64)).Masked().Addr().As16()
+			copy(b[8:], host[8:])
+			b[15] = byte(1 + rand.IntN(255))
+			a = netip.AddrFrom16(b)
+			if !block.Contains(a) {
+				a = block.Addr()
+			}
+		}
+		if !seen[a] {
+			seen[a] = true
+			ips = append(ips, a)
+		}
+	}
+	return ips
+}
+
+// expandIPv6 replaces IPv6 prefixes by their sampleIPv6 picks as /128s,
+// leaving IPv4 prefixes to CloudflareScanner's own per-/24 sampling.
+func expandIPv6(prefixes []netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			out = append(out, p)
+			continue
+		}
+		for _, a := range sampleIPv6(p) {
+			out = append(out, netip.PrefixFrom(a, 128))
+		}
+	}
+	return out
+}
+
+// splitPrefix splits an IPv4 prefix into its sub-prefixes of length bits.
+func splitPrefix(p netip.Prefix, bits int) []netip.Prefix {
+	if p.Bits() >= bits {
+		return []netip.Prefix{p}
+	}
+	n := 1 << (bits - p.Bits())
+	out := make([]netip.Prefix, 0, n)
+	base := p.Addr().As4()
+	start := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	step := uint32(1) << (32 - bits)
+	for i := 0; i < n; i++ {
+		v := start + uint32(i)*step
+		a := netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+		out = append(out, netip.PrefixFrom(a, bits))
+	}
+	return out
+}
+
+// randomAddr returns a random address inside p.
+func randomAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		if rand.IntN(2) == 1 {
+			b[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// probeIPs TCP-connects to every IP times times using threads workers and
+// returns the IPs that answered at least once.
+func probeIPs(ips []netip.Addr, port, times, threads int) []ScanResult {
+	threads = max(threads, 1)
+	times = max(times, 1)
+	jobs := make(chan netip.Addr)
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []ScanResult
+	)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range jobs {
+				r := tcping(ip, port, times)
+				if r.Received == 0 {
+					continue
+				}
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, ip := range ips {
+		jobs <- ip
+	}
+	close(jobs)
+	wg.Wait()
+	sortScanResults(results)
+	return results
+}
+
+func tcping(ip netip.Addr, port, times int) ScanResult {
+	addr := netip.AddrPortFrom(ip, uint16(port)).String()
+	r := ScanResult{IP: ip.String(), Sent: times}
+	var total time.Duration
+	for i := 0; i < times; i++ {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, nativeDialTimeout)
+		if err != nil {
+			continue
+		}
+		total += time.Since(start)
+		conn.Close()
+		r.Received++
+	}
+	if r.Received > 0 {
+		r.Latency = total / time.Duration(r.Received)
+	}
+	return r
+}
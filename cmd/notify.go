@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// run-cron reports cycle results to notification sinks: a webhook with a
+// templated JSON body (NOTIFY_WEBHOOK_URL), the Telegram Bot API
+// (NOTIFY_TELEGRAM_TOKEN) and a shell command (NOTIFY_COMMAND). NOTIFY_ON
+// picks the events: failure, recovery (first success after failures),
+// change (the deployed IP set changed by at least NOTIFY_CHANGE_THRESHOLD)
+// and cycle (every cycle). Each event kind is sent at most once per
+// NOTIFY_MIN_INTERVAL minutes; dropped events are counted in the next one.
+
+// notifyEvent is what sinks receive, and the data of webhook templates.
+type notifyEvent struct {
+	Event  string    `json:"event"` // failure, recovery, change or cycle
+	RunID  string    `json:"run_id,omitempty"`
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"` // ok or failed
+	Error  string    `json:"error,omitempty"`
+	// Circuit is run-cron's circuit breaker state; update was skipped when open.
+	Circuit string `json:"circuit,omitempty"`
+	// IPs is the number of IPs deployed by this cycle, PrevIPs by the last
+	// successful one; Added and Removed are the difference.
+	IPs     int      `json:"ips"`
+	PrevIPs int      `json:"prev_ips"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Failures is the number of failed cycles in a row.
+	Failures int `json:"failures"`
+	// Suppressed counts events of this kind the rate limit dropped since
+	// the last one sent.
+	Suppressed int    `json:"suppressed,omitempty"`
+	Text       string `json:"text"`
+}
+
+type notifySink interface {
+	name() string
+	send(ctx context.Context, ev notifyEvent) error
+}
+
+type notifier struct {
+	sinks           []notifySink
+	on              map[string]bool
+	minInterval     time.Duration
+	changeThreshold float64
+	timeout         time.Duration
+	now             func() time.Time
+
+	failures   int
+	baseline   []string // IPs of the last successful cycle
+	haveBase   bool
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+var notifyEvents = []string{"failure", "recovery", "change", "cycle"}
+
+// notifierFromEnv builds the notifier, or returns nil when no sink is set.
+func notifierFromEnv() (*notifier, error) {
+	timeout := time.Duration(envInt("NOTIFY_TIMEOUT", 10)) * time.Second
+	var sinks []notifySink
+	if u := os.Getenv("NOTIFY_WEBHOOK_URL"); u != "" {
+		s, err := newWebhookSink(u, os.Getenv("NOTIFY_WEBHOOK_TEMPLATE"), timeout)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if token := os.Getenv("NOTIFY_TELEGRAM_TOKEN"); token != "" {
+		chat := os.Getenv("NOTIFY_TELEGRAM_CHAT_ID")
+		if chat == "" {
+			return nil, fmt.Errorf("NOTIFY_TELEGRAM_CHAT_ID must be set with NOTIFY_TELEGRAM_TOKEN")
+		}
+		sinks = append(sinks, telegramSink{
+			API:    strings.TrimSuffix(envStr("NOTIFY_TELEGRAM_API", "https://api.telegram.org"), "/"),
+			Token:  token,
+			ChatID: chat,
+			client: &http.Client{Timeout: timeout},
+		})
+	}
+	if c := os.Getenv("NOTIFY_COMMAND"); c != "" {
+		sinks = append(sinks, commandSink{Command: c})
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	on := map[string]bool{}
+	for _, e := range strings.Split(envStr("NOTIFY_ON", "failure,recovery"), ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !slices.Contains(notifyEvents, e) {
+			return nil, fmt.Errorf("NOTIFY_ON: unknown event %q (use %s)", e, strings.Join(notifyEvents, ", "))
+		}
+		on[e] = true
+	}
+	return &notifier{
+		sinks:           sinks,
+		on:              on,
+		minInterval:     time.Duration(envFloat("NOTIFY_MIN_INTERVAL", 30) * float64(time.Minute)),
+		changeThreshold: envFloat("NOTIFY_CHANGE_THRESHOLD", 0.5),
+		timeout:         timeout,
+		now:             time.Now,
+		last:            map[string]time.Time{},
+		suppressed:      map[string]int{},
+	}, nil
+}
+
+// observe turns the outcome of one cycle into events and sends them. m may
+// be nil when the cycle panicked.
+func (n *notifier) observe(m *runManifest, err error) {
+	ev := notifyEvent{Time: n.now().UTC(), Status: "ok", PrevIPs: len(n.baseline)}
+	var ips []string
+	if m != nil {
+		ev.RunID, ev.Circuit, ips = m.ID, m.Circuit, m.IPs
+	}
+	ev.IPs = len(ips)
+	deployed := "deployed"
+	if ev.Circuit == circuitOpen {
+		deployed = "generated (circuit open, panel not updated)"
+	}
+
+	var events []notifyEvent
+	if err != nil {
+		n.failures++
+		ev.Status, ev.Error, ev.Failures = "failed", err.Error(), n.failures
+		ev.Event, ev.Text = "failure", fmt.Sprintf("cfscanner run %s failed (%d in a row): %v", ev.RunID, n.failures, err)
+		events = append(events, ev)
+	} else if ev.Circuit == circuitOpen {
+		// The panel was skipped: nothing recovered and nothing was deployed.
+		ev.Failures = n.failures
+	} else {
+		if n.failures > 0 {
+			r := ev
+			r.Event = "recovery"
+			r.Text = fmt.Sprintf("cfscanner run %s recovered after %d failed cycle(s); %d IPs %s", ev.RunID, n.failures, ev.IPs, deployed)
+			events = append(events, r)
+		}
+		n.failures = 0
+		ev.Added, ev.Removed = diffIPSets(n.baseline, ips)
+		if n.haveBase && ipSetChange(n.baseline, ev.Added, ev.Removed) >= n.changeThreshold {
+			c := ev
+			c.Event = "change"
+			c.Text = fmt.Sprintf("cfscanner deployed IPs changed: %d -> %d (+%d -%d)", ev.PrevIPs, ev.IPs, len(ev.Added), len(ev.Removed))
+			events = append(events, c)
+		}
+		n.baseline, n.haveBase = ips, true
+	}
+	if err == nil {
+		ev.Text = fmt.Sprintf("cfscanner run %s ok: %d IPs %s", ev.RunID, ev.IPs, deployed)
+	}
+	ev.Event = "cycle"
+	events = append(events, ev)
+
+	for _, e := range events {
+		if n.on[e.Event] {
+			n.dispatch(e)
+		}
+	}
+}
+
+// dispatch sends ev to every sink unless its kind was sent too recently.
+// Sink failures are logged; they never fail the cycle.
+func (n *notifier) dispatch(ev notifyEvent) {
+	log := stageLog("notify").With("event", ev.Event)
+	if last, ok := n.last[ev.Event]; ok && n.now().Sub(last) < n.minInterval {
+		n.suppressed[ev.Event]++
+		log.Info("rate limited", "next_after", last.Add(n.minInterval).Format(time.RFC3339))
+		return
+	}
+	n.last[ev.Event] = n.now()
+	ev.Suppressed, n.suppressed[ev.Event] = n.suppressed[ev.Event], 0
+	for _, s := range n.sinks {
+		ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+		err := s.send(ctx, ev)
+		cancel()
+		if err != nil {
+			log.Warn("notification failed", "sink", s.name(), "err", err)
+			continue
+		}
+		log.Info("notification sent", "sink", s.name())
+	}
+}
+
+// diffIPSets returns the IPs only in cur and those only in prev.
+func diffIPSets(prev, cur []string) (added, removed []string) {
+	for _, ip := range cur {
+		if !slices.Contains(prev, ip) {
+			added = append(added, ip)
+		}
+	}
+	for _, ip := range prev {
+		if !slices.Contains(cur, ip) {
+			removed = append(removed, ip)
+		}
+	}
+	return added, removed
+}
+
+// ipSetChange is the share of the union of both sets that is not in both.
+func ipSetChange(prev, added, removed []string) float64 {
+	union := len(prev) + len(added)
+	if union == 0 {
+		return 0
+	}
+	return float64(len(added)+len(removed)) / float64(union)
+}
+
+// webhookSink POSTs the event as JSON, or the rendering of a text/template
+// whose data is the event; {{json .X}} encodes a value.
+type webhookSink struct {
+	URL    string
+	tmpl   *template.Template
+	client *http.Client
+}
+
+func newWebhookSink(rawURL, tmpl string, timeout time.Duration) (webhookSink, error) {
+	s := webhookSink{URL: rawURL, client: &http.Client{Timeout: timeout}}
+	if tmpl != "" {
+		t, err := template.New("webhook").Funcs(template.FuncMap{"json": templateJSON}).Parse(tmpl)
+		if err != nil {
+			return s, fmt.Errorf("NOTIFY_WEBHOOK_TEMPLATE: %w", err)
+		}
+		s.tmpl = t
+	}
+	return s, nil
+}
+
+func templateJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (s webhookSink) name() string { return "webhook" }
+
+func (s webhookSink) send(ctx context.Context, ev notifyEvent) error {
+	var body []byte
+	if s.tmpl == nil {
+		body, _ = json.Marshal(ev)
+	} else {
+		var buf bytes.Buffer
+		if err := s.tmpl.Execute(&buf, ev); err != nil {
+			return err
+		}
+		if !json.Valid(buf.Bytes()) {
+			return fmt.Errorf("NOTIFY_WEBHOOK_TEMPLATE rendered invalid JSON: %s", buf.String())
+		}
+		body = buf.Bytes()
+	}
+	return postJSON(ctx, s.client, s.URL, body, nil)
+}
+
+// telegramSink sends the event text with the Bot API's sendMessage.
+type telegramSink struct {
+	API    string
+	Token  string
+	ChatID string
+	client *http.Client
+}
+
+func (s telegramSink) name() string { return "telegram" }
+
+func (s telegramSink) send(ctx context.Context, ev notifyEvent) error {
+	body, _ := json.Marshal(map[string]string{"chat_id": s.ChatID, "text": ev.Text})
+	var reply struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := postJSON(ctx, s.client, s.API+"/bot"+s.Token+"/sendMessage", body, &reply); err != nil {
+		return err
+	}
+	if !reply.OK {
+		return fmt.Errorf("telegram: %s", reply.Description)
+	}
+	return nil
+}
+
+// postJSON posts body and decodes a JSON reply into out, if given. Errors
+// leave the URL out, since the Telegram one holds the bot token.
+func postJSON(ctx context.Context, client *http.Client, rawURL string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return stripURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return stripURL(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if out != nil && json.Unmarshal(data, out) == nil {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, redactBody(data))
+	}
+	return nil
+}
+
+func stripURL(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return ue.Err
+	}
+	return err
+}
+
+// commandSink runs a shell command with the event as JSON on stdin and
+// NOTIFY_EVENT, NOTIFY_TEXT and NOTIFY_RUN_ID in its environment.
+type commandSink struct {
+	Command string
+}
+
+func (s commandSink) name() string { return "command" }
+
+func (s commandSink) send(ctx context.Context, ev notifyEvent) error {
+	data, _ := json.Marshal(ev)
+	c := exec.CommandContext(ctx, "sh", "-c", s.Command)
+	c.Stdin = bytes.NewReader(data)
+	c.Env = append(os.Environ(), "NOTIFY_EVENT="+ev.Event, "NOTIFY_TEXT="+ev.Text, "NOTIFY_RUN_ID="+ev.RunID)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyStandIn records the JSON bodies posted to it, keyed by path.
+type notifyStandIn struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies map[string][]map[string]interface{}
+}
+
+func newNotifyStandIn(t *testing.T) *notifyStandIn {
+	s := &notifyStandIn{bodies: map[string][]map[string]interface{}{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var v map[string]interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Errorf("%s: body is not JSON: %s", r.URL.Path, data)
+		}
+		s.mu.Lock()
+		s.bodies[r.URL.Path] = append(s.bodies[r.URL.Path], v)
+		s.mu.Unlock()
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *notifyStandIn) posts(path string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies[path]
+}
+
+func TestNotifierSinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("command sink needs sh")
+	}
+	srv := newNotifyStandIn(t)
+	out := filepath.Join(t.TempDir(), "events")
+	t.Setenv("NOTIFY_WEBHOOK_URL", srv.URL+"/hook")
+	t.Setenv("NOTIFY_WEBHOOK_TEMPLATE", `{"text": {{json .Text}}, "kind": "{{.Event}}"}`)
+	t.Setenv("NOTIFY_TELEGRAM_TOKEN", "123:abc")
+	t.Setenv("NOTIFY_TELEGRAM_CHAT_ID", "42")
+	t.Setenv("NOTIFY_TELEGRAM_API", srv.URL)
+	t.Setenv("NOTIFY_COMMAND", `echo "$NOTIFY_EVENT" >> `+out)
+	t.Setenv("NOTIFY_ON", "failure,recovery")
+
+	n, err := notifierFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.observe(&runManifest{ID: "r1"}, errors.New("update: panel down"))
+	// A scan-only cycle with the circuit open has not reached the panel.
+	n.observe(&runManifest{ID: "r2", Circuit: circuitOpen, IPs: []string{"1.1.1.1"}}, nil)
+	n.observe(&runManifest{ID: "r3", IPs: []string{"1.1.1.1"}}, nil)
+
+	hooks := srv.posts("/hook")
+	if len(hooks) != 2 || hooks[0]["kind"] != "failure" || hooks[1]["kind"] != "recovery" {
+		t.Fatalf("webhook posts = %v", hooks)
+	}
+	if !strings.Contains(hooks[0]["text"].(string), "panel down") {
+		t.Errorf("failure text = %q", hooks[0]["text"])
+	}
+	if !strings.Contains(hooks[1]["text"].(string), "run r3 recovered") {
+		t.Errorf("recovery text = %q", hooks[1]["text"])
+	}
+	tg := srv.posts("/bot123:abc/sendMessage")
+	if len(tg) != 2 || tg[0]["chat_id"] != "42" {
+		t.Errorf("telegram posts = %v", tg)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil || string(data) != "failure\nrecovery\n" {
+		t.Errorf("command sink wrote %q (%v)", data, err)
+	}
+}
+
+func TestNotifierChangeAndRateLimit(t *testing.T) {
+	srv := newNotifyStandIn(t)
+	t.Setenv("NOTIFY_WEBHOOK_URL", srv.URL+"/hook")
+	t.Setenv("NOTIFY_ON", "change")
+	t.Setenv("NOTIFY_MIN_INTERVAL", "10")
+	n, err := notifierFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	n.observe(&runManifest{IPs: []string{"a", "b", "c", "d"}}, nil) // baseline
+	n.observe(&runManifest{IPs: []string{"a", "b", "c", "e"}}, nil) // 2 of 5 changed: below 0.5
+	n.observe(&runManifest{IPs: []string{"x", "y"}}, nil)           // all changed
+	now = now.Add(time.Minute)
+	n.observe(&runManifest{IPs: []string{"a"}}, nil) // rate limited
+	now = now.Add(10 * time.Minute)
+	n.observe(&runManifest{IPs: []string{"x", "y", "z"}}, nil)
+
+	hooks := srv.posts("/hook")
+	if len(hooks) != 2 {
+		t.Fatalf("got %d change events, want 2: %v", len(hooks), hooks)
+	}
+	if hooks[0]["prev_ips"] != 4.0 || hooks[0]["ips"] != 2.0 {
+		t.Errorf("first change = %v", hooks[0])
+	}
+	if hooks[1]["suppressed"] != 1.0 {
+		t.Errorf("second change should count the suppressed one: %v", hooks[1])
+	}
+}
+
+func TestNotifierFromEnvRejectsUnknownEvent(t *testing.T) {
+	t.Setenv("NOTIFY_COMMAND", "true")
+	t.Setenv("NOTIFY_ON", "failure,sometimes")
+	if _, err := notifierFromEnv(); err == nil {
+		t.Error("NOTIFY_ON=sometimes accepted")
+	}
+}
@@ -0,0 +1,494 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// xuiCredentials holds everything posted to the panel's /login form.
+type xuiCredentials struct {
+	Username string
+	Password string
+	// TwoFactorSecret is the base32 TOTP seed; the current code is derived from it.
+	TwoFactorSecret string
+	// LoginSecret is the "secret token" field of older 3x-ui versions.
+	LoginSecret string
+}
+
+// panelOptions configures how a panelSession reaches the panel.
+type panelOptions struct {
+	BaseURL       string
+	WebBasePath   string
+	AllowInsecure bool
+	// CAFile is a PEM bundle trusted instead of the system roots.
+	CAFile string
+	// CertSHA256 pins the panel certificate (or one in its chain) by hex fingerprint.
+	CertSHA256 string
+	// ClientCert and ClientKey are PEM files presented for mTLS.
+	ClientCert string
+	ClientKey  string
+	// Proxy is an http(s):// or socks5:// URL; empty falls back to HTTPS_PROXY.
+	Proxy string
+	// Timeout bounds each HTTP request, including reading the body.
+	Timeout time.Duration
+	// Retries is how many extra attempts idempotent calls get; UpdateRetries
+	// is the same for the config update POST.
+	Retries       int
+	UpdateRetries int
+	// RetryDelay is the first backoff delay; it doubles on every attempt.
+	RetryDelay time.Duration
+}
+
+func panelOptionsFromEnv() panelOptions {
+	return panelOptions{
+		BaseURL:       os.Getenv("XUI_URL"),
+		WebBasePath:   os.Getenv("XUI_WEB_BASE_PATH"),
+		AllowInsecure: envBool("XUI_ALLOW_INSECURE", false),
+		CAFile:        os.Getenv("XUI_CA_FILE"),
+		CertSHA256:    os.Getenv("XUI_CERT_SHA256"),
+		ClientCert:    os.Getenv("XUI_CLIENT_CERT"),
+		ClientKey:     os.Getenv("XUI_CLIENT_KEY"),
+		Proxy:         os.Getenv("XUI_PROXY"),
+		Timeout:       time.Duration(envInt("XUI_TIMEOUT", 30)) * time.Second,
+		Retries:       envInt("XUI_RETRIES", 3),
+		UpdateRetries: envInt("XUI_UPDATE_RETRIES", 1),
+		RetryDelay:    time.Duration(envFloat("XUI_RETRY_DELAY", 1) * float64(time.Second)),
+	}
+}
+
+// panelSession is a logged-in connection to one 3x-ui panel. The session
+// cookie lives in the client's jar, whatever name the panel gives it.
+type panelSession struct {
+	// baseURL is XUI_URL joined with the web base path, without a trailing slash.
+	baseURL string
+	client  *http.Client
+	opts    panelOptions
+}
+
+func xrayClient(opts panelOptions) (*http.Client, error) {
+	tlsConfig, err := panelTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := panelProxy(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	return &http.Client{Transport: transport}, nil
+}
+
+// panelProxy returns the proxy selector for panel calls: XUI_PROXY when set,
+// otherwise the standard HTTPS_PROXY/HTTP_PROXY/NO_PROXY variables.
+func panelProxy(raw string) (func(*http.Request) (*url.URL, error), error) {
+	if raw == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("XUI_PROXY: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("XUI_PROXY: unsupported scheme %q (use http, https, socks5 or socks5h)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("XUI_PROXY: missing host in %q", raw)
+	}
+	return http.ProxyURL(u), nil
+}
+
+var errCertPinMismatch = errors.New("panel certificate does not match XUI_CERT_SHA256")
+
+// panelTLSConfig builds the TLS settings for panel calls, or nil when the
+// defaults apply. A pinned fingerprint alone replaces chain verification
+// (for self-signed panels); together with a CA bundle both must pass.
+func panelTLSConfig(opts panelOptions) (*tls.Config, error) {
+	if !opts.AllowInsecure && opts.CAFile == "" && opts.CertSHA256 == "" && opts.ClientCert == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: opts.AllowInsecure}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("XUI_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("XUI_CA_FILE: no PEM certificates in %s", opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		if opts.ClientCert == "" || opts.ClientKey == "" {
+			return nil, fmt.Errorf("XUI_CLIENT_CERT and XUI_CLIENT_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.CertSHA256 != "" {
+		pin, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(opts.CertSHA256))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("XUI_CERT_SHA256 must be a hex SHA-256 fingerprint")
+		}
+		if opts.CAFile == "" && !opts.AllowInsecure {
+			cfg.InsecureSkipVerify = true
+		}
+		matches := func(cert *x509.Certificate) bool {
+			sum := sha256.Sum256(cert.Raw)
+			return bytes.Equal(sum[:], pin)
+		}
+		verified := !cfg.InsecureSkipVerify
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			// Without chain verification the rest of PeerCertificates is
+			// whatever the server chose to send, so only the leaf counts.
+			if !verified {
+				if len(cs.PeerCertificates) > 0 && matches(cs.PeerCertificates[0]) {
+					return nil
+				}
+				return errCertPinMismatch
+			}
+			for _, chain := range cs.VerifiedChains {
+				if slices.ContainsFunc(chain, matches) {
+					return nil
+				}
+			}
+			return errCertPinMismatch
+		}
+	}
+	return cfg, nil
+}
+
+// panelBaseURL joins the panel URL and its web base path (e.g. "/secret/").
+func panelBaseURL(baseURL, webBasePath string) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	if p := strings.Trim(webBasePath, "/"); p != "" {
+		baseURL += "/" + p
+	}
+	return baseURL
+}
+
+func newPanelSession(opts panelOptions) (*panelSession, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := xrayClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	client.Jar = jar
+	client.Timeout = opts.Timeout
+	// Redirects are never followed: on an API call they mean the panel
+	// sent us back to its login page.
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &panelSession{baseURL: panelBaseURL(opts.BaseURL, opts.WebBasePath), client: client, opts: opts}, nil
+}
+
+// retryableError marks failures worth another attempt: transport errors,
+// 5xx from the panel or its proxy, and 429.
+type retryableError struct{ err error }
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// backoff returns the delay before retry n (1-based): base doubled per
+// attempt, capped at 30s, with ±50% jitter. A base of 0 disables the delay.
+func backoff(base time.Duration, n int) time.Duration {
+	const maxDelay = 30 * time.Second
+	if base <= 0 {
+		return 0
+	}
+	d := min(base, maxDelay)
+	for i := 1; i < n && d < maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxDelay)
+	return d/2 + time.Duration(rand.Int64N(int64(d)+1))
+}
+
+// post sends a POST to path under the panel base URL, retrying retryable
+// failures up to opts.Retries times. form may be nil for an empty body.
+func (s *panelSession) post(path string, form url.Values) (*http.Response, []byte, error) {
+	return s.postRetry(path, func() url.Values { return form }, s.opts.Retries)
+}
+
+// postRetry is post with its own retry count; form is called for every
+// attempt, so a body with a time-based field is fresh on each one.
+func (s *panelSession) postRetry(path string, form func() url.Values, retries int) (*http.Response, []byte, error) {
+	var waited time.Duration
+	for attempt := 1; ; attempt++ {
+		resp, body, err := s.postOnce(path, form())
+		if err == nil && attempt > 1 {
+			stageLog("panel").Info("request succeeded after retrying", "path", path, "attempts", attempt, "delay", waited.Round(time.Millisecond))
+		}
+		var re retryableError
+		if err == nil || !errors.As(err, &re) || attempt > retries {
+			return resp, body, err
+		}
+		delay := backoff(s.opts.RetryDelay, attempt)
+		waited += delay
+		stageLog("panel").Warn("request failed; retrying", "path", path, "attempt", attempt, "attempts", retries+1, "err", err, "delay", delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// postOnce performs a single request. Redirects and 401s are reported as
+// a lost session.
+func (s *panelSession) postOnce(path string, form url.Values) (*http.Response, []byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(http.MethodPost, s.baseURL+path, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+	}
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// A certificate that fails verification will not pass on retry.
+		var verr *tls.CertificateVerificationError
+		if errors.As(err, &verr) || errors.Is(err, errCertPinMismatch) {
+			return nil, nil, err
+		}
+		return nil, nil, retryableError{err}
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, retryableError{err}
+	}
+
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		return resp, data, fmt.Errorf("%s: panel redirected to %q, the session was not accepted (check XUI_URL and XUI_WEB_BASE_PATH)", path, resp.Header.Get("Location"))
+	case resp.StatusCode == http.StatusUnauthorized:
+		return resp, data, fmt.Errorf("%s: panel asked to log in again, the session was not accepted", path)
+	case resp.StatusCode == http.StatusNotFound:
+		return resp, data, fmt.Errorf("%s: not found on panel (check XUI_WEB_BASE_PATH)", path)
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return resp, data, retryableError{fmt.Errorf("%s: panel returned status %d", path, resp.StatusCode)}
+	}
+	return resp, data, nil
+}
+
+// flag asks a boolean panel endpoint such as /getTwoFactorEnable. It
+// reports false when the endpoint is missing or answers unexpectedly.
+func (s *panelSession) flag(path string) bool {
+	_, body, err := s.post(path, nil)
+	if err != nil {
+		return false
+	}
+	var wrapper struct {
+		Success bool `json:"success"`
+		Obj     bool `json:"obj"`
+	}
+	if err := json.Unmarshal(body, &wrapper); err != nil {
+		return false
+	}
+	return wrapper.Success && wrapper.Obj
+}
+
+// loginError turns a rejected login into a message naming the factors that
+// were sent. 3x-ui answers every rejection with the same localized message,
+// so it cannot tell which one was wrong.
+func loginError(msg string, creds xuiCredentials) error {
+	sent := []string{"password"}
+	check := []string{"XUI_USERNAME/XUI_PASSWORD"}
+	if creds.TwoFactorSecret != "" {
+		sent = append(sent, "two-factor code")
+		check = append(check, "XUI_TWO_FACTOR_SECRET and the host clock")
+	}
+	if creds.LoginSecret != "" {
+		sent = append(sent, "login secret")
+		check = append(check, "XUI_LOGIN_SECRET")
+	}
+	return fmt.Errorf("3x-ui login rejected (%s sent; check %s): %s", strings.Join(sent, " + "), strings.Join(check, ", "), msg)
+}
+
+func (s *panelSession) login(creds xuiCredentials) error {
+	if creds.TwoFactorSecret == "" && s.flag("/getTwoFactorEnable") {
+		return fmt.Errorf("panel has two-factor authentication enabled; set XUI_TWO_FACTOR_SECRET")
+	}
+	if creds.LoginSecret == "" && s.flag("/getSecretStatus") {
+		return fmt.Errorf("panel requires a login secret; set XUI_LOGIN_SECRET")
+	}
+
+	if creds.TwoFactorSecret != "" {
+		if _, err := totpCode(creds.TwoFactorSecret, time.Now()); err != nil {
+			return err
+		}
+	}
+	// The code is computed per attempt: a retry after backoff may fall in
+	// the next 30-second step.
+	form := func() url.Values {
+		form := url.Values{}
+		form.Set("username", creds.Username)
+		form.Set("password", creds.Password)
+		if creds.TwoFactorSecret != "" {
+			code, _ := totpCode(creds.TwoFactorSecret, time.Now())
+			form.Set("twoFactorCode", code)
+		}
+		if creds.LoginSecret != "" {
+			form.Set("loginSecret", creds.LoginSecret)
+		}
+		return form
+	}
+
+	resp, body, err := s.postRetry("/login", form, s.opts.Retries)
+	if err != nil {
+		return err
+	}
+
+	var wrapper struct {
+		Success bool   `json:"success"`
+		Msg     string `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &wrapper); err == nil && !wrapper.Success {
+		return loginError(wrapper.Msg, creds)
+	}
+
+	u, _ := url.Parse(s.baseURL + "/")
+	if len(s.client.Jar.Cookies(u)) > 0 {
+		return nil
+	}
+	// A reverse proxy may rewrite the cookie's Domain or Path so that the
+	// jar refuses it; pin whatever the panel sent to the panel URL instead.
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		stageLog("panel").Debug("login response", "status", resp.StatusCode, "body", redactBody(body))
+		return fmt.Errorf("no session cookie in login response (status %d)", resp.StatusCode)
+	}
+	for _, c := range cookies {
+		c.Domain = ""
+		c.Path = "/"
+	}
+	s.client.Jar.SetCookies(u, cookies)
+	return nil
+}
+
+// panelResult decodes the {success, msg} wrapper shared by panel endpoints.
+// An empty body with a 2xx status counts as success.
+func panelResult(what string, resp *http.Response, body []byte) error {
+	if len(strings.TrimSpace(string(body))) == 0 {
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		return fmt.Errorf("%s status %d with empty body", what, resp.StatusCode)
+	}
+	var wrapper struct {
+		Success bool   `json:"success"`
+		Msg     string `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &wrapper); err != nil {
+		stageLog("panel").Debug("undecodable response", "what", what, "body", redactBody(body))
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	if !wrapper.Success {
+		return fmt.Errorf("%s success=false: %s", what, wrapper.Msg)
+	}
+	return nil
+}
+
+func (s *panelSession) getPanelConfig() (string, error) {
+	_, body, err := s.post("/panel/xray/", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var wrapper struct {
+		Success bool   `json:"success"`
+		Msg     string `json:"msg"`
+		Obj     string `json:"obj"`
+	}
+	if err := json.Unmarshal(body, &wrapper); err != nil {
+		stageLog("panel").Debug("undecodable panel config", "body", redactBody(body))
+		return "", err
+	}
+	if !wrapper.Success {
+		stageLog("panel").Debug("panel config refused", "body", redactBody(body))
+		return "", fmt.Errorf("panel response success=false: %s", wrapper.Msg)
+	}
+	return wrapper.Obj, nil
+}
+
+func (s *panelSession) getOutbounds() ([]interface{}, error) {
+	obj, err := s.getPanelConfig()
+	if err != nil {
+		return nil, err
+	}
+	var xray struct {
+		XraySetting struct {
+			Outbounds []interface{} `json:"outbounds"`
+		} `json:"xraySetting"`
+	}
+	if err := json.Unmarshal([]byte(obj), &xray); err != nil {
+		stageLog("panel").Debug("undecodable xray config", "obj", redactBody([]byte(obj)))
+		return nil, err
+	}
+	return xray.XraySetting.Outbounds, nil
+}
+
+func (s *panelSession) putPanelConfig(xraySetting map[string]interface{}) error {
+	xrayJSON, err := json.Marshal(xraySetting)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("xraySetting", string(xrayJSON))
+
+	resp, body, err := s.postRetry("/panel/xray/update", func() url.Values { return form }, s.opts.UpdateRetries)
+	if err != nil {
+		return err
+	}
+	return panelResult("panel update", resp, body)
+}
+
+func (s *panelSession) restartXrayService() error {
+	_, body, err := s.post("/panel/api/server/restartXrayService", nil)
+	if err != nil {
+		return err
+	}
+	// Only an explicit success=false is a failure; some panel versions
+	// answer with an empty or non-JSON body.
+	var wrapper struct {
+		Success bool   `json:"success"`
+		Msg     string `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &wrapper); err == nil && !wrapper.Success {
+		return fmt.Errorf("restartXrayService success=false: %s", wrapper.Msg)
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SamMHD/cfscanner-to-3xui/internal/xuimock"
+)
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		base     time.Duration
+		n        int
+		min, max time.Duration
+	}{
+		{0, 1, 0, 0},
+		{0, 100, 0, 0},
+		{-time.Second, 3, 0, 0},
+		{time.Second, 1, 500 * time.Millisecond, 1500 * time.Millisecond},
+		{time.Second, 3, 2 * time.Second, 6 * time.Second},
+		{time.Second, 6, 15 * time.Second, 45 * time.Second}, // 32s capped at 30s
+		{time.Second, 64, 15 * time.Second, 45 * time.Second},
+		{time.Second, 1000, 15 * time.Second, 45 * time.Second},
+		{time.Hour, 1, 15 * time.Second, 45 * time.Second},
+	} {
+		for range 20 {
+			if d := backoff(tc.base, tc.n); d < tc.min || d > tc.max {
+				t.Errorf("backoff(%s, %d) = %s, want within [%s, %s]", tc.base, tc.n, d, tc.min, tc.max)
+				break
+			}
+		}
+	}
+}
+
+func TestPostRetryLogsRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := baseLogger
+	t.Cleanup(func() { baseLogger = prev })
+	baseLogger = l
+
+	panel := xuimock.New("admin", "secret", panelXraySetting())
+	t.Cleanup(panel.Close)
+	panel.FailLogin, panel.FailTimes = xuimock.BadGateway, 2
+	s, err := newPanelSession(panelOptions{BaseURL: panel.URL, Timeout: 5 * time.Second, Retries: 3, RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.login(xuiCredentials{Username: "admin", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	var recovered map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if json.Unmarshal([]byte(line), &m) == nil && m["msg"] == "request succeeded after retrying" {
+			recovered = m
+		}
+	}
+	if recovered == nil || recovered["path"] != "/login" || recovered["attempts"] != 3.0 || recovered["level"] != "INFO" {
+		t.Errorf("no recovery line with 3 attempts in:\n%s", buf.String())
+	}
+}
+
+// selfSigned returns a fresh self-signed certificate for 127.0.0.1.
+func selfSigned(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "foreign"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// tlsServer serves over TLS presenting chain, signed with key.
+func tlsServer(t *testing.T, key crypto.PrivateKey, chain ...*x509.Certificate) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // rejected handshakes are expected
+	var raw [][]byte
+	for _, c := range chain {
+		raw = append(raw, c.Raw)
+	}
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: raw, PrivateKey: key}}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func fingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPanelCertPin(t *testing.T) {
+	panel := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	panel.Config.ErrorLog = log.New(io.Discard, "", 0)
+	panel.StartTLS()
+	t.Cleanup(panel.Close)
+	panelCert, panelKey := panel.Certificate(), panel.TLS.Certificates[0].PrivateKey
+	foreign, foreignKey := selfSigned(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: panelCert.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		opts   panelOptions
+		wantOK bool
+	}{
+		{"pin matches leaf", panel.URL, panelOptions{CertSHA256: fingerprint(panelCert)}, true},
+		{"pin mismatch", panel.URL, panelOptions{CertSHA256: fingerprint(foreign)}, false},
+		// A MITM presenting its own leaf with the public panel cert appended.
+		{"pinned cert after foreign leaf", tlsServer(t, foreignKey, foreign, panelCert).URL,
+			panelOptions{CertSHA256: fingerprint(panelCert)}, false},
+		{"pinned cert after foreign leaf, insecure", tlsServer(t, foreignKey, foreign, panelCert).URL,
+			panelOptions{CertSHA256: fingerprint(panelCert), AllowInsecure: true}, false},
+		{"CA and pin in verified chain", panel.URL, panelOptions{CAFile: caFile, CertSHA256: fingerprint(panelCert)}, true},
+		// The appended cert is sent but not part of the verified chain.
+		{"CA and pin of unverified extra cert", tlsServer(t, panelKey, panelCert, foreign).URL,
+			panelOptions{CAFile: caFile, CertSHA256: fingerprint(foreign)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := panelTLSConfig(tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: 5 * time.Second}
+			resp, err := client.Get(tc.url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tc.wantOK && err != nil {
+				t.Errorf("request failed: %v", err)
+			}
+			if !tc.wantOK && (err == nil || !strings.Contains(err.Error(), errCertPinMismatch.Error())) {
+				t.Errorf("err = %v, want pin mismatch", err)
+			}
+		})
+	}
+}
+
+// forwardProxy is an HTTP forward proxy that sends every request to
+// target, whatever host it names, and records the requested URLs.
+type forwardProxy struct {
+	*httptest.Server
+	mu   sync.Mutex
+	seen []string
+}
+
+func newForwardProxy(t *testing.T, target string) *forwardProxy {
+	p := &forwardProxy{}
+	transport := &http.Transport{Proxy: nil}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.seen = append(p.seen, r.URL.String())
+		p.mu.Unlock()
+		out := r.Clone(r.Context())
+		out.RequestURI = ""
+		out.URL.Host = target
+		resp, err := transport.RoundTrip(out)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *forwardProxy) requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.seen)
+}
+
+// socks5Proxy is a minimal no-auth SOCKS5 server that connects every
+// CONNECT to target and records the requested addresses.
+func socks5Proxy(t *testing.T, target string) (addr string, seen func() []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var (
+		mu    sync.Mutex
+		dests []string
+	)
+	handle := func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, 262)
+		// Greeting: version, method count, methods; answer "no auth".
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+			return
+		}
+		c.Write([]byte{5, 0})
+		// Request: version, CONNECT, reserved, address type, address, port.
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return
+		}
+		var host string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(c, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 4:
+			io.ReadFull(c, buf[:16])
+			host = net.IP(buf[:16]).String()
+		case 3:
+			io.ReadFull(c, buf[:1])
+			n := int(buf[0])
+			io.ReadFull(c, buf[:n])
+			host = string(buf[:n])
+		}
+		io.ReadFull(c, buf[:2])
+		mu.Lock()
+		dests = append(dests, net.JoinHostPort(host, fmt.Sprint(int(buf[0])<<8|int(buf[1]))))
+		mu.Unlock()
+		up, err := net.Dial("tcp", target)
+		if err != nil {
+			c.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer up.Close()
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(up, c)
+		io.Copy(c, up)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return ln.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(dests)
+	}
+}
+
+func TestPanelThroughProxy(t *testing.T) {
+	panel := xuimock.New("admin", "secret", panelXraySetting())
+	t.Cleanup(panel.Close)
+	target := panel.Listener.Addr().String()
+	login := func(proxy string) error {
+		s, err := newPanelSession(panelOptions{BaseURL: panel.URL, Proxy: proxy, Timeout: 5 * time.Second})
+		if err != nil {
+			return err
+		}
+		if err := s.login(xuiCredentials{Username: "admin", Password: "secret"}); err != nil {
+			return err
+		}
+		_, err = s.getPanelConfig()
+		return err
+	}
+
+	httpProxy := newForwardProxy(t, target)
+	if err := login(httpProxy.URL); err != nil {
+		t.Fatalf("via HTTP proxy: %v", err)
+	}
+	if got := httpProxy.requests(); !slices.Contains(got, panel.URL+"/login") || !slices.Contains(got, panel.URL+"/panel/xray/") {
+		t.Errorf("HTTP proxy saw %v", got)
+	}
+
+	socksAddr, seen := socks5Proxy(t, target)
+	if err := login("socks5://" + socksAddr); err != nil {
+		t.Fatalf("via SOCKS5 proxy: %v", err)
+	}
+	if got := seen(); len(got) == 0 || got[0] != target {
+		t.Errorf("SOCKS5 proxy saw %v, want %s", got, target)
+	}
+
+	if err := login("ftp://" + socksAddr); err == nil || !strings.Contains(err.Error(), "unsupported scheme") {
+		t.Errorf("ftp proxy: err = %v", err)
+	}
+}
+
+// TestPanelProxyFromEnvironment checks the HTTP_PROXY / NO_PROXY fallback
+// in a child process, since net/http reads those variables only once per
+// process and never proxies loopback addresses.
+func TestPanelProxyFromEnvironment(t *testing.T) {
+	if base := os.Getenv("CFSCANNER_PROXY_CHILD_URL"); base != "" {
+		s, err := newPanelSession(panelOptions{BaseURL: base, Timeout: 2 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.login(xuiCredentials{Username: "admin", Password: "secret"})
+		if want := os.Getenv("CFSCANNER_PROXY_CHILD_WANT"); (err == nil) != (want == "ok") {
+			t.Fatalf("login err = %v, want %s", err, want)
+		}
+		return
+	}
+
+	panel := xuimock.New("admin", "secret", panelXraySetting())
+	t.Cleanup(panel.Close)
+	proxy := newForwardProxy(t, panel.Listener.Addr().String())
+	child := func(base, noProxy, want string) {
+		t.Helper()
+		c := exec.Command(os.Args[0], "-test.run=^TestPanelProxyFromEnvironment$")
+		c.Env = append(os.Environ(),
+			"CFSCANNER_PROXY_CHILD_URL="+base, "CFSCANNER_PROXY_CHILD_WANT="+want,
+			"HTTP_PROXY="+proxy.URL, "NO_PROXY="+noProxy, "XUI_RETRIES=0")
+		if out, err := c.CombinedOutput(); err != nil {
+			t.Fatalf("child %s (NO_PROXY=%q): %v\n%s", base, noProxy, err, out)
+		}
+	}
+
+	// panel.invalid only resolves through the proxy.
+	child("http://panel.invalid", "", "ok")
+	if got := proxy.requests(); !slices.Contains(got, "http://panel.invalid/login") {
+		t.Fatalf("proxy saw %v", got)
+	}
+	n := len(proxy.requests())
+	child("http://panel.invalid", "other.invalid,panel.invalid", "fail")
+	if got := proxy.requests(); len(got) != n {
+		t.Errorf("NO_PROXY host went through the proxy: %v", got[n:])
+	}
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Ptechgithub/CloudflareScanner/task"
+)
+
+// IP ranges to scan come from SCAN_SOURCES, a comma-separated list whose
+// entries are each one of:
+//
+//	1.2.3.0/24, 2606:4700::/32, 1.1.1.1   inline CIDR or address
+//	https://www.cloudflare.com/ips-v4     URL, cached in SCAN_SOURCE_CACHE
+//	ranges/                               directory; every file in it
+//	ip.txt                                file, one range per line
+//
+// Without SCAN_SOURCES, SCAN_IP or SCAN_F are used as before. SCAN_EXCLUDE
+// takes the same kinds of entries and is subtracted from the result.
+
+// resolveScanRanges loads every configured source and removes exclusions.
+func resolveScanRanges() ([]netip.Prefix, error) {
+	var include []string
+	switch {
+	case os.Getenv("SCAN_SOURCES") != "":
+		include = strings.Split(os.Getenv("SCAN_SOURCES"), ",")
+	case task.IPText != "":
+		include = strings.Split(task.IPText, ",")
+	default:
+		include = []string{task.IPFile}
+	}
+	prefixes, err := loadRangeSources(include)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no IP ranges found in the scan sources")
+	}
+	if ex := os.Getenv("SCAN_EXCLUDE"); ex != "" {
+		excluded, err := loadRangeSources(strings.Split(ex, ","))
+		if err != nil {
+			return nil, fmt.Errorf("SCAN_EXCLUDE: %w", err)
+		}
+		prefixes = excludePrefixes(prefixes, excluded)
+	}
+	return prefixes, nil
+}
+
+func loadRangeSources(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		got, err := loadRangeSource(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry, err)
+		}
+		prefixes = append(prefixes, got...)
+	}
+	return dedupePrefixes(prefixes), nil
+}
+
+func loadRangeSource(entry string) ([]netip.Prefix, error) {
+	if strings.HasPrefix(entry, "http://") || strings.HasPrefix(entry, "https://") {
+		data, err := fetchRangeURL(entry)
+		if err != nil {
+			return nil, err
+		}
+		return parseRangeList(data, false)
+	}
+	if p, ok, err := parseScanPrefix(entry); err == nil && ok {
+		return []netip.Prefix{p}, nil
+	}
+	info, err := os.Stat(entry)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		data, err := os.ReadFile(entry)
+		if err != nil {
+			return nil, err
+		}
+		return parseRangeList(data, true)
+	}
+	files, err := os.ReadDir(entry)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []netip.Prefix
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(entry, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		got, err := parseRangeList(data, true)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		prefixes = append(prefixes, got...)
+	}
+	return prefixes, nil
+}
+
+// parseRangeList parses one range per line; "#" starts a comment. Local
+// files must be clean (strict); lines of downloaded lists that do not parse
+// are skipped, since community lists often carry headers or notes.
+func parseRangeList(data []byte, strict bool) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		p, ok, err := parseScanPrefix(line)
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		}
+		if ok {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes, sc.Err()
+}
+
+// fetchRangeURL returns the body of a range list URL. A cached copy younger
+// than SCAN_SOURCE_TTL minutes is used as is; on a failed or empty fetch the
+// last good copy is used, however old.
+func fetchRangeURL(rawURL string) ([]byte, error) {
+	dir := workPath(envStr("SCAN_SOURCE_CACHE", "range-cache"))
+	sum := sha256.Sum256([]byte(rawURL))
+	cached := filepath.Join(dir, hex.EncodeToString(sum[:8])+".txt")
+	ttl := time.Duration(envInt("SCAN_SOURCE_TTL", 1440)) * time.Minute
+
+	if info, err := os.Stat(cached); err == nil && time.Since(info.ModTime()) < ttl {
+		return os.ReadFile(cached)
+	}
+
+	data, err := downloadRangeList(rawURL)
+	if err == nil {
+		if err := writeFileAtomic(cached, data); err != nil {
+			stageLog("scan").Warn("could not cache range list", "url", rawURL, "err", err)
+		}
+		return data, nil
+	}
+	old, cacheErr := os.ReadFile(cached)
+	if cacheErr != nil {
+		return nil, err
+	}
+	stageLog("scan").Warn("range list download failed; using cached copy", "url", rawURL, "err", err)
+	return old, nil
+}
+
+func downloadRangeList(rawURL string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := parseRangeList(data, false); len(got) == 0 {
+		return nil, fmt.Errorf("no IP ranges in response")
+	}
+	return data, nil
+}
+
+// writeFileAtomic writes data to a temp file next to path, fsyncs it and
+// renames it over path, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := ensureDir(path); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// parseScanPrefix parses one range line; blank lines and # comments are
+// skipped (ok=false).
+func parseScanPrefix(line string) (netip.Prefix, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return netip.Prefix{}, false, nil
+	}
+	if !strings.Contains(line, "/") {
+		addr, err := netip.ParseAddr(line)
+		if err != nil {
+			return netip.Prefix{}, false, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), true, nil
+	}
+	p, err := netip.ParsePrefix(line)
+	if err != nil {
+		return netip.Prefix{}, false, err
+	}
+	return p.Masked(), true, nil
+}
+
+// dedupePrefixes sorts prefixes and drops any contained in another.
+func dedupePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+	var out []netip.Prefix
+	for _, p := range prefixes {
+		if n := len(out); n > 0 && out[n-1].Contains(p.Addr()) && out[n-1].Bits() <= p.Bits() {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// excludePrefixes removes every address in excluded from prefixes,
+// splitting ranges that partly overlap an exclusion.
+func excludePrefixes(prefixes, excluded []netip.Prefix) []netip.Prefix {
+	for _, ex := range excluded {
+		var next []netip.Prefix
+		for _, p := range prefixes {
+			next = append(next, subtractPrefix(p, ex)...)
+		}
+		prefixes = next
+	}
+	return prefixes
+}
+
+// subtractPrefix returns p minus ex as a list of prefixes.
+func subtractPrefix(p, ex netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(ex) {
+		return []netip.Prefix{p}
+	}
+	if ex.Bits() <= p.Bits() {
+		return nil // ex covers p
+	}
+	// p strictly contains ex: keep the half without ex and recurse into the other.
+	lo, hi := splitHalves(p)
+	if lo.Contains(ex.Addr()) {
+		return append([]netip.Prefix{hi}, subtractPrefix(lo, ex)...)
+	}
+	return append([]netip.Prefix{lo}, subtractPrefix(hi, ex)...)
+}
+
+// splitHalves splits p into its two prefixes one bit longer.
+func splitHalves(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := p.Bits() + 1
+	lo := netip.PrefixFrom(p.Addr(), bits)
+	b := p.Addr().AsSlice()
+	i := bits - 1
+	b[i/8] |= 1 << (7 - i%8)
+	hiAddr, _ := netip.AddrFromSlice(b)
+	return lo, netip.PrefixFrom(hiAddr, bits)
+}
+
+// writeRangeFile writes prefixes one per line for CloudflareScanner's -f.
+func writeRangeFile(path string, prefixes []netip.Prefix) error {
+	var buf bytes.Buffer
+	for _, p := range prefixes {
+		buf.WriteString(p.String())
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func prefixStrings(prefixes []netip.Prefix) string {
+	var s []string
+	for _, p := range prefixes {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	got := excludePrefixes(
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/22"), netip.MustParsePrefix("10.1.0.0/24")},
+		[]netip.Prefix{netip.MustParsePrefix("10.0.1.0/24"), netip.MustParsePrefix("10.1.0.0/16")},
+	)
+	if want := "10.0.0.0/24,10.0.2.0/23"; prefixStrings(dedupePrefixes(got)) != want {
+		t.Errorf("got %s, want %s", prefixStrings(got), want)
+	}
+}
+
+func TestResolveScanRangesFromSources(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	var fail bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("# Cloudflare ranges\n173.245.48.0/20\nnot-a-range\n"))
+	}))
+	defer srv.Close()
+
+	if err := os.Mkdir("ranges", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("ranges", "extra.txt"), []byte("104.16.0.0/24 # extra\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SCAN_SOURCES", srv.URL+",ranges,1.1.1.1")
+	t.Setenv("SCAN_EXCLUDE", "173.245.56.0/21")
+	t.Setenv("SCAN_SOURCE_TTL", "0")
+
+	want := "1.1.1.1/32,104.16.0.0/24,173.245.48.0/21"
+	got, err := resolveScanRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefixStrings(got) != want {
+		t.Fatalf("got %s, want %s", prefixStrings(got), want)
+	}
+
+	// The URL going down falls back to the cached copy.
+	fail = true
+	got, err = resolveScanRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefixStrings(got) != want {
+		t.Errorf("with cache fallback got %s, want %s", prefixStrings(got), want)
+	}
+}
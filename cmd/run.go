@@ -2,31 +2,68 @@ package cmd
 
 import (
 	"fmt"
+	"path/filepath"
+	"runtime/debug"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var runCmd = &cobra.Command{
 	Use:   "run",
-	Short: "Run scan, then generate, then update",
+	Short: "Validate templates, then run scan, verify (if VERIFY is set), generate and update",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		root := cmd.Root()
-		for _, name := range []string{"scan", "generate", "update"} {
-			c, _, err := root.Find([]string{name})
-			if err != nil {
-				return fmt.Errorf("find %s: %w", name, err)
-			}
-			if name == "scan" {
-				c.Run(c, nil)
-				continue
-			}
-			if err := c.RunE(c, nil); err != nil {
-				return fmt.Errorf("%s: %w", name, err)
+		_, err := runStages(cmd.Root(), "")
+		return err
+	},
+}
+
+// runStages runs the pipeline once and returns the saved run manifest.
+// circuit is run-cron's circuit breaker state; when open, update is
+// skipped. A panic in a stage fails the run like an error.
+func runStages(root *cobra.Command, circuit string) (m *runManifest, err error) {
+	m = newRunManifest()
+	m.Circuit = circuit
+	activeRun = m
+	defer func() {
+		if r := recover(); r != nil {
+			stageLog("run").Error("panic recovered", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+			if n := len(m.Stages); n > 0 && m.Stages[n-1].End.IsZero() {
+				m.endStage(err)
 			}
-			fmt.Printf("[%s] completed\n", name)
 		}
-		return nil
-	},
+		if ferr := m.finish(err); ferr != nil {
+			stageLog("run").Error("could not save run manifest", "err", ferr)
+		} else if dir := runHistoryDir(); dir != "" {
+			stageLog("run").Info("manifest saved", "path", filepath.Join(dir, m.ID+".json"))
+		}
+		activeRun = nil
+	}()
+	stages := []string{"validate", "scan", "generate", "update"}
+	if verifyEnabled() {
+		stages = []string{"validate", "scan", "verify", "generate", "update"}
+	}
+	for _, name := range stages {
+		if name == "update" && circuit == circuitOpen {
+			stageLog(name).Warn("skipped: circuit open")
+			continue
+		}
+		c, _, err := root.Find([]string{name})
+		if err != nil {
+			return m, fmt.Errorf("find %s: %w", name, err)
+		}
+		m.beginStage(name)
+		start := time.Now()
+		err = c.RunE(c, nil)
+		m.endStage(err)
+		if err != nil {
+			stageLog(name).Error("failed", "err", err, "duration", time.Since(start))
+			return m, fmt.Errorf("%s: %w", name, err)
+		}
+		stageLog(name).Info("completed", "duration", time.Since(start))
+	}
+	return m, nil
 }
 
 func init() {
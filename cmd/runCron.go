@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -20,29 +21,27 @@ var runCronCmd = &cobra.Command{
 			return fmt.Errorf("minutes must be >= 1")
 		}
 		interval := time.Duration(n) * time.Minute
-		runOnce := func() error {
-			return runCmd.RunE(runCmd, nil)
+		if hotUpdate() {
+			if err := xrayAPIFromEnv().check(); err != nil {
+				return err
+			}
 		}
-		for {
-			var err error
-			panicked := false
-			func() {
-				defer func() {
-					if r := recover(); r != nil {
-						fmt.Printf("[run-cron] panic recovered: %v\n", r)
-						panicked = true
-					}
-				}()
-				err = runOnce()
-			}()
-			if panicked {
-				// continue to next cycle
-			} else if err != nil {
+		notify, err := notifierFromEnv()
+		if err != nil {
+			return err
+		}
+		policy := newCronPolicy(interval)
+		if addr := os.Getenv("STATUS_ADDR"); addr != "" {
+			if err := serveStatus(addr, policy); err != nil {
 				return err
-			} else {
-				fmt.Println("[run-cron] cycle completed")
 			}
-			time.Sleep(interval)
+		}
+		for {
+			m, err := runStages(cmd.Root(), policy.beginCycle())
+			if notify != nil {
+				notify.observe(m, err)
+			}
+			time.Sleep(policy.endCycle(m, err))
 		}
 	},
 }
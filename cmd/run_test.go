@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Ptechgithub/CloudflareScanner/task"
+	"github.com/Ptechgithub/CloudflareScanner/utils"
+)
+
+const trojanTemplate = `{
+  "protocol": "trojan",
+  "settings": {"servers": [{"address": "0.0.0.0", "port": 443, "password": "pass"}]},
+  "streamSettings": {"network": "ws", "security": "tls"}
+}`
+
+// TestRunAgainstFakePanel drives scan → generate → update with the scanner
+// pointed at a local TCP listener and the update at a fake panel.
+func TestRunAgainstFakePanel(t *testing.T) {
+	panel := setupUpdate(t, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	ipText, port, pingTimes, disable := task.IPText, task.TCPPort, task.PingTimes, task.Disable
+	printNum, output := utils.PrintNum, utils.Output
+	t.Cleanup(func() {
+		task.IPText, task.TCPPort, task.PingTimes, task.Disable = ipText, port, pingTimes, disable
+		utils.PrintNum, utils.Output = printNum, output
+	})
+	t.Setenv("SCAN_O", "ip-scan-result.csv")
+	task.IPText = "127.0.0.1"
+	task.TCPPort = ln.Addr().(*net.TCPAddr).Port
+	task.PingTimes = 1
+	task.Disable = true
+	utils.PrintNum = 0
+
+	if err := os.Mkdir("configs", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("configs/trojan.json", []byte(trojanTemplate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCmd.RunE(runCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(outboundTags(panel.Outbounds()), ",")
+	if want := "direct,blocked,cf-clean-trojan-127.0.0.1"; got != want {
+		t.Errorf("outbounds = %s, want %s", got, want)
+	}
+	if panel.Restarts != 1 {
+		t.Errorf("restarts = %d, want 1", panel.Restarts)
+	}
+
+	// The run left a manifest linking the stages together.
+	files, err := listRunManifests("runs")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("manifests = %v, %v; want one", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m runManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := os.ReadFile(generatedOutboundsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Status != "ok" || m.OutboundsHash != sha256Hex(generated) || m.Outbounds != 1 || m.Templates["trojan.json"] != sha256Hex([]byte(trojanTemplate)) {
+		t.Errorf("manifest = %+v", m)
+	}
+	if got := stageIPs(m.Stages); got != "1>1" {
+		t.Errorf("IPs per stage = %s, want 1>1", got)
+	}
+	if len(m.Panels) != 1 || !m.Panels[0].Updated || m.Panels[0].Restart != "ok" || m.Panels[0].URL != panel.URL {
+		t.Errorf("panels = %+v", m.Panels)
+	}
+	if m.Scan["port"] != float64(task.TCPPort) {
+		t.Errorf("scan settings = %v", m.Scan)
+	}
+}
+
+func TestPruneRunHistory(t *testing.T) {
+	dir := t.TempDir()
+	for _, id := range []string{"20260101T000000Z-aa", "20260102T000000Z-bb", "20260103T000000Z-cc"} {
+		if err := os.WriteFile(filepath.Join(dir, id+".json"), []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pruneRunHistory(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := listRunManifests(dir)
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	if got, want := strings.Join(names, ","), "20260103T000000Z-cc.json,20260102T000000Z-bb.json"; got != want {
+		t.Errorf("kept %s, want %s", got, want)
+	}
+}
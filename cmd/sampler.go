@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// With SCAN_SAMPLER=adaptive each cycle probes SCAN_SAMPLE_BUDGET IPs:
+// SCAN_EXPLORE of them at random /24s across all ranges, the rest in
+// subnets whose IPs scored well in the history database, previously good
+// IPs first. Without history the whole budget explores.
+
+// adaptiveSampling reports whether SCAN_SAMPLER selects the adaptive sampler.
+func adaptiveSampling() bool {
+	return strings.EqualFold(envStr("SCAN_SAMPLER", "random"), "adaptive")
+}
+
+// subnetOf returns the block an address is grouped in for sampling: its
+// /24 for IPv4, its /48 for IPv6.
+func subnetOf(a netip.Addr) netip.Prefix {
+	bits := 24
+	if !a.Is4() {
+		bits = 48
+	}
+	p, _ := a.Prefix(bits)
+	return p
+}
+
+// blockCount is the number of sampling blocks (see subnetOf) in p, capped
+// to keep the arithmetic in range for huge IPv6 prefixes.
+func blockCount(p netip.Prefix) uint64 {
+	bits := subnetOf(p.Addr()).Bits()
+	if p.Bits() >= bits {
+		return 1
+	}
+	return 1 << min(bits-p.Bits(), 40)
+}
+
+// randomBlockAddr picks a random block across prefixes, weighted by size,
+// and a random address inside it.
+func randomBlockAddr(prefixes []netip.Prefix, total uint64) netip.Addr {
+	r := rand.Uint64N(total)
+	for _, p := range prefixes {
+		n := blockCount(p)
+		if r < n {
+			return randomAddr(p)
+		}
+		r -= n
+	}
+	return randomAddr(prefixes[len(prefixes)-1])
+}
+
+// adaptiveSample returns up to budget addresses inside prefixes, spending
+// (1-explore) of it on historically good subnets.
+func adaptiveSample(prefixes []netip.Prefix, budget int, explore float64) ([]netip.Addr, error) {
+	if len(prefixes) == 0 || budget <= 0 {
+		return nil, nil
+	}
+	explore = min(max(explore, 0), 1)
+	inRanges := func(a netip.Addr) bool {
+		for _, p := range prefixes {
+			if p.Contains(a) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var scores []ipScore
+	if db, err := openHistoryDB(); err != nil {
+		return nil, err
+	} else if db != nil {
+		scores, err = rankIPs(db, envInt("HISTORY_WINDOW", 10), envFloat("HISTORY_ALPHA", 0.3))
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[netip.Addr]bool{}
+	var ips []netip.Addr
+	add := func(a netip.Addr) {
+		if !seen[a] {
+			seen[a] = true
+			ips = append(ips, a)
+		}
+	}
+
+	// Exploit: re-test known good IPs, then spread the rest over their
+	// subnets in proportion to the subnets' summed scores.
+	exploit := budget - int(float64(budget)*explore)
+	weights := map[netip.Prefix]float64{}
+	var total float64
+	for _, s := range scores {
+		a, err := netip.ParseAddr(s.IP)
+		if err != nil || !inRanges(a) {
+			continue
+		}
+		if len(ips) < exploit {
+			add(a)
+		}
+		weights[subnetOf(a)] += s.Score
+		total += s.Score
+	}
+	if total > 0 {
+		subnets := make([]netip.Prefix, 0, len(weights))
+		for p := range weights {
+			subnets = append(subnets, p)
+		}
+		sort.Slice(subnets, func(i, j int) bool { return weights[subnets[i]] > weights[subnets[j]] })
+		remaining := exploit - len(ips)
+		for _, p := range subnets {
+			share := int(math.Round(float64(remaining) * weights[p] / total))
+			for added, tries := 0, 0; added < share && tries < share*4 && len(ips) < exploit; tries++ {
+				if a := randomAddr(p); !seen[a] && inRanges(a) {
+					add(a)
+					added++
+				}
+			}
+		}
+	}
+	exploited := len(ips)
+
+	// Explore: the rest of the budget goes to random blocks of all ranges.
+	var blocks uint64
+	for _, p := range prefixes {
+		blocks += blockCount(p)
+	}
+	for tries := 0; len(ips) < budget && tries < budget*4; tries++ {
+		add(randomBlockAddr(prefixes, blocks))
+	}
+	stageLog("scan").Info("adaptive sampler", "ips", len(ips), "exploited", exploited,
+		"good_subnets", len(weights), "exploring", len(ips)-exploited)
+	return ips, nil
+}
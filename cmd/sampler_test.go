@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestAdaptiveSampleFocusesOnGoodSubnets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	t.Setenv("HISTORY_DB", path)
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := []ScanResult{{IP: "10.0.5.7", Latency: 50 * time.Millisecond}, {IP: "10.9.9.9", Latency: 50 * time.Millisecond}}
+	for i := 0; i < 3; i++ {
+		if err := recordCycle(db, time.Unix(int64(1700000000+i), 0), good, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// 10.9.9.9 is outside the ranges now and must be ignored.
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}
+	ips, err := adaptiveSample(prefixes, 100, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 100 {
+		t.Fatalf("got %d IPs, want the whole budget of 100", len(ips))
+	}
+	focus := netip.MustParsePrefix("10.0.5.0/24")
+	inFocus, hasKnown := 0, false
+	for _, a := range ips {
+		if !prefixes[0].Contains(a) {
+			t.Fatalf("%s is outside the scan ranges", a)
+		}
+		if focus.Contains(a) {
+			inFocus++
+		}
+		hasKnown = hasKnown || a.String() == "10.0.5.7"
+	}
+	if !hasKnown {
+		t.Error("known good IP 10.0.5.7 was not re-tested")
+	}
+	if inFocus < 80 {
+		t.Errorf("%d of 100 IPs in the good /24, want at least 80", inFocus)
+	}
+}
+
+func TestAdaptiveSampleWithoutHistoryExplores(t *testing.T) {
+	t.Setenv("HISTORY_DB", "off")
+	ips, err := adaptiveSample([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}, 50, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 50 {
+		t.Errorf("got %d IPs, want 50", len(ips))
+	}
+}
+
+func TestSampleIPv6SpreadsOverBlocks(t *testing.T) {
+	t.Setenv("SCAN_V6_SAMPLES", "32")
+	p := netip.MustParsePrefix("2606:4700::/32")
+	for _, strategy := range []string{"random", "low"} {
+		t.Setenv("SCAN_V6_STRATEGY", strategy)
+		ips := sampleIPv6(p)
+		if len(ips) != 32 {
+			t.Fatalf("%s: got %d IPs, want 32", strategy, len(ips))
+		}
+		blocks := map[netip.Prefix]bool{}
+		for _, a := range ips {
+			if !p.Contains(a) {
+				t.Fatalf("%s: %s is outside %s", strategy, a, p)
+			}
+			if strategy == "low" && a.As16()[14] != 0 {
+				t.Fatalf("low: %s has a high interface ID", a)
+			}
+			blocks[subnetOf(a)] = true
+		}
+		if len(blocks) < 30 {
+			t.Errorf("%s: samples fell in only %d /48s", strategy, len(blocks))
+		}
+	}
+}
@@ -71,17 +71,37 @@ Options:
         Print program version + check for updates
     -h
         Print help instructions`,
-	Run: func(cmd *cobra.Command, args []string) {
-		task.InitRandSeed() // Set random seed
-
-		// Start latency testing + filter delay/loss
-		pingData := task.NewPing().Run().FilterDelay().FilterLossRate()
-		// Start download speed testing
-		speedData := task.TestDownloadSpeed(pingData)
-		utils.ExportCsv(speedData) // Export to file
-		speedData.Print()          // Print results
-		endPrint()
-	},
+	RunE: runScan,
+}
+
+func runScan(cmd *cobra.Command, args []string) error {
+	utils.Output = scanOutputPath()
+	scanner, err := scannerFromEnv()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	results, err := scanner.Scan()
+	if err != nil {
+		return err
+	}
+	sortScanResults(results)
+	noteIPs(len(results))
+	var probed []string
+	if p, ok := scanner.(probeReporter); ok {
+		probed = p.Probed()
+	}
+	if err := recordScanHistory(start, results, probed); err != nil {
+		return err
+	}
+	if utils.Output != "" && len(results) > 0 {
+		if err := writeScanCSV(utils.Output, results); err != nil {
+			return err
+		}
+	}
+	printScanResults(results) // Print results
+	endPrint()
+	return nil
 }
 
 func envInt(key string, def int) int {
@@ -157,8 +177,6 @@ func init() {
 	task.IPFile = envStr("SCAN_F", "ip.txt")
 	// Inline IP ranges (comma-separated)
 	task.IPText = envStr("SCAN_IP", "")
-	// Output CSV path
-	utils.Output = envStr("SCAN_O", "ip-scan-result.csv")
 
 	// Disable download test; sort by latency only
 	task.Disable = envBool("SCAN_DD", false)
@@ -166,7 +184,7 @@ func init() {
 	task.TestAll = envBool("SCAN_ALLIP", false)
 
 	if task.MinSpeed > 0 && time.Duration(maxDelay)*time.Millisecond == utils.InputMaxDelay {
-		fmt.Println("[Tip] When using [-sl] parameter, it is recommended to use [-tl] parameter to avoid continuous testing due to insufficient number of [-dn]...")
+		baseLogger.Warn("SCAN_SL is set without SCAN_TL; testing may continue until SCAN_DN IPs reach the minimum speed")
 	}
 	utils.InputMaxDelay = time.Duration(maxDelay) * time.Millisecond
 	utils.InputMinDelay = time.Duration(minDelay) * time.Millisecond
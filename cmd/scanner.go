@@ -0,0 +1,357 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ptechgithub/CloudflareScanner/task"
+	"github.com/Ptechgithub/CloudflareScanner/utils"
+)
+
+// ScanResult is one candidate IP with the scores a backend measured.
+// Backends leave fields they do not measure at zero.
+type ScanResult struct {
+	IP       string
+	Colo     string
+	Sent     int
+	Received int
+	// Latency is the average latency of successful probes.
+	Latency time.Duration
+	// DownloadSpeed is in bytes per second.
+	DownloadSpeed float64
+	// Handshake is the average end-to-end handshake time measured by verify.
+	Handshake time.Duration
+	// FailedTemplates are the template variants (outboundTemplate.variant)
+	// verify could not complete a handshake for through this IP.
+	FailedTemplates []string
+}
+
+// LossRate is the fraction of probes that failed.
+func (r ScanResult) LossRate() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent)
+}
+
+// Scanner produces scored candidate IPs. scan, run and run-cron only see
+// this interface; SCAN_BACKEND picks the implementation.
+type Scanner interface {
+	Scan() ([]ScanResult, error)
+}
+
+// probeReporter is implemented by backends that know which IPs their last
+// Scan probed, found or not. The history only counts a cycle against an IP
+// that was probed in it; backends that cannot tell never count misses.
+type probeReporter interface {
+	Probed() []string
+}
+
+// probedIPs renders addrs for probeReporter.
+func probedIPs(addrs []netip.Addr) []string {
+	ips := make([]string, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.String()
+	}
+	return ips
+}
+
+// scannerFromEnv returns the backend named by SCAN_BACKEND.
+func scannerFromEnv() (Scanner, error) {
+	switch backend := strings.ToLower(envStr("SCAN_BACKEND", "cloudflarescanner")); backend {
+	case "cloudflarescanner", "cfscanner":
+		return &cfScanner{}, nil
+	case "native":
+		return &nativeScanner{}, nil
+	case "command":
+		command := os.Getenv("SCAN_COMMAND")
+		if command == "" {
+			return nil, fmt.Errorf("SCAN_BACKEND=command requires SCAN_COMMAND")
+		}
+		return commandScanner{Command: command}, nil
+	case "static":
+		return staticScanner{IPs: os.Getenv("SCAN_STATIC_IPS"), File: os.Getenv("SCAN_STATIC_FILE")}, nil
+	default:
+		return nil, fmt.Errorf("unknown SCAN_BACKEND %q (want cloudflarescanner, native, command or static)", backend)
+	}
+}
+
+// sortScanResults orders by download speed when any was measured,
+// otherwise by loss rate and then latency.
+func sortScanResults(results []ScanResult) {
+	bySpeed := false
+	for _, r := range results {
+		if r.DownloadSpeed > 0 {
+			bySpeed = true
+			break
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if bySpeed {
+			return results[i].DownloadSpeed > results[j].DownloadSpeed
+		}
+		if li, lj := results[i].LossRate(), results[j].LossRate(); li != lj {
+			return li < lj
+		}
+		return results[i].Latency < results[j].Latency
+	})
+}
+
+var scanCSVHeader = []string{"IP Address", "Sent", "Received", "Loss Rate", "Average Delay", "Download Speed (MB/s)", "Colo", "Handshake (ms)", "Failed Templates"}
+
+// writeScanCSV writes results in the CloudflareScanner CSV layout with
+// extra Colo, Handshake and Failed Templates (";"-separated) columns.
+func writeScanCSV(path string, results []ScanResult) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(scanCSVHeader)
+	for _, r := range results {
+		_ = w.Write([]string{
+			r.IP,
+			strconv.Itoa(r.Sent),
+			strconv.Itoa(r.Received),
+			strconv.FormatFloat(r.LossRate(), 'f', 2, 64),
+			strconv.FormatFloat(float64(r.Latency)/float64(time.Millisecond), 'f', 2, 64),
+			strconv.FormatFloat(r.DownloadSpeed/1024/1024, 'f', 2, 64),
+			r.Colo,
+			strconv.FormatFloat(float64(r.Handshake)/float64(time.Millisecond), 'f', 2, 64),
+			strings.Join(r.FailedTemplates, ";"),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// parseScanCSV reads a scan CSV (ours, CloudflareScanner's, or any file
+// whose first column is the IP). The header row is optional.
+func parseScanCSV(data []byte) ([]ScanResult, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var results []ScanResult
+	for i, row := range rows {
+		if i == 0 && len(row) > 0 && row[0] == "IP Address" {
+			continue
+		}
+		if len(row) == 0 || strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		res := ScanResult{IP: strings.TrimSpace(row[0])}
+		if len(row) >= 6 {
+			res.Sent, _ = strconv.Atoi(row[1])
+			res.Received, _ = strconv.Atoi(row[2])
+			ms, _ := strconv.ParseFloat(row[4], 64)
+			res.Latency = time.Duration(ms * float64(time.Millisecond))
+			mbps, _ := strconv.ParseFloat(row[5], 64)
+			res.DownloadSpeed = mbps * 1024 * 1024
+		}
+		if len(row) >= 7 {
+			res.Colo = row[6]
+		}
+		if len(row) >= 8 {
+			ms, _ := strconv.ParseFloat(row[7], 64)
+			res.Handshake = time.Duration(ms * float64(time.Millisecond))
+		}
+		if len(row) >= 9 && row[8] != "" {
+			res.FailedTemplates = strings.Split(row[8], ";")
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// parseScanJSON accepts either an array of IP strings or an array of
+// objects with at least an "ip" field.
+func parseScanJSON(data []byte) ([]ScanResult, error) {
+	var ips []string
+	if err := json.Unmarshal(data, &ips); err == nil {
+		results := make([]ScanResult, 0, len(ips))
+		for _, ip := range ips {
+			results = append(results, ScanResult{IP: ip})
+		}
+		return results, nil
+	}
+	var rows []struct {
+		IP            string  `json:"ip"`
+		Colo          string  `json:"colo"`
+		Sent          int     `json:"sent"`
+		Received      int     `json:"received"`
+		LatencyMS     float64 `json:"latency_ms"`
+		DownloadSpeed float64 `json:"download_mbps"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	results := make([]ScanResult, 0, len(rows))
+	for _, row := range rows {
+		if row.IP == "" {
+			continue
+		}
+		results = append(results, ScanResult{
+			IP:            row.IP,
+			Colo:          row.Colo,
+			Sent:          row.Sent,
+			Received:      row.Received,
+			Latency:       time.Duration(row.LatencyMS * float64(time.Millisecond)),
+			DownloadSpeed: row.DownloadSpeed * 1024 * 1024,
+		})
+	}
+	return results, nil
+}
+
+// cfScanner runs github.com/Ptechgithub/CloudflareScanner, configured
+// through its package globals by scan.go's init.
+type cfScanner struct {
+	probed []string
+}
+
+func (s *cfScanner) Probed() []string { return s.probed }
+
+func (s *cfScanner) Scan() ([]ScanResult, error) {
+	task.InitRandSeed() // Set random seed
+
+	// Ranges are resolved here and handed over as a generated -f file of
+	// sampled addresses (the adaptive sampler's picks, or one per /24 and
+	// sampleIPv6's picks), so the probed IPs are known. Only SCAN_ALL hands
+	// over the ranges, with IPv6 still sampled since CloudflareScanner
+	// cannot walk a /32.
+	prefixes, err := resolveScanRanges()
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	switch {
+	case adaptiveSampling():
+		ips, err = adaptiveSample(prefixes, envInt("SCAN_SAMPLE_BUDGET", 1000), envFloat("SCAN_EXPLORE", 0.2))
+		if err != nil {
+			return nil, err
+		}
+	case !task.TestAll:
+		ips = sampleIPs(prefixes, false)
+	}
+	s.probed = nil
+	if ips != nil {
+		prefixes = prefixes[:0]
+		for _, ip := range ips {
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+		}
+		s.probed = probedIPs(ips)
+	} else {
+		prefixes = expandIPv6(prefixes)
+	}
+	path := filepath.Join(workPath(envStr("SCAN_SOURCE_CACHE", "range-cache")), "scan-ranges.txt")
+	if err := writeRangeFile(path, prefixes); err != nil {
+		return nil, err
+	}
+	ipFile, ipText := task.IPFile, task.IPText
+	defer func() { task.IPFile, task.IPText = ipFile, ipText }()
+	task.IPFile, task.IPText = path, ""
+
+	// Start latency testing + filter delay/loss
+	pingData := task.NewPing().Run().FilterDelay().FilterLossRate()
+	// Start download speed testing
+	speedData := task.TestDownloadSpeed(pingData)
+
+	results := make([]ScanResult, 0, len(speedData))
+	for _, d := range speedData {
+		results = append(results, ScanResult{
+			IP:            d.IP.String(),
+			Sent:          d.Sended,
+			Received:      d.Received,
+			Latency:       d.Delay,
+			DownloadSpeed: d.DownloadSpeed,
+		})
+	}
+	lookupColos(results)
+	return results, nil
+}
+
+// commandScanner runs an external scanner and parses its stdout as CSV or
+// JSON, whichever it looks like.
+type commandScanner struct {
+	Command string
+}
+
+func (s commandScanner) Scan() ([]ScanResult, error) {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", s.Command)
+	} else {
+		c = exec.Command("sh", "-c", s.Command)
+	}
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("SCAN_COMMAND: %w", err)
+	}
+	out = bytes.TrimSpace(out)
+	if len(out) > 0 && (out[0] == '[' || out[0] == '{') {
+		return parseScanJSON(out)
+	}
+	return parseScanCSV(out)
+}
+
+// staticScanner returns a fixed list of IPs without probing them.
+type staticScanner struct {
+	// IPs is comma-separated; File holds one IP per line. Both may be set.
+	IPs  string
+	File string
+}
+
+func (s staticScanner) Scan() ([]ScanResult, error) {
+	list := strings.Split(s.IPs, ",")
+	if s.File != "" {
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, strings.Split(string(data), "\n")...)
+	}
+	var results []ScanResult
+	for _, ip := range list {
+		if ip = strings.TrimSpace(ip); ip != "" && !strings.HasPrefix(ip, "#") {
+			results = append(results, ScanResult{IP: ip})
+		}
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("static scanner: no IPs in SCAN_STATIC_IPS or SCAN_STATIC_FILE")
+	}
+	return results, nil
+}
+
+// printScanResults prints the first utils.PrintNum results as a table.
+func printScanResults(results []ScanResult) {
+	if utils.NoPrintResult() {
+		return
+	}
+	if len(results) == 0 {
+		fmt.Println("\n[Info] The number of complete test results IP is 0, skipping output results.")
+		return
+	}
+	n := min(utils.PrintNum, len(results))
+	fmt.Printf("%-40s%-6s%-10s%-11s%-15s%-15s%s\n", "IP Address", "Sent", "Received", "Loss-Rate", "Average-Delay", "Speed (MB/s)", "Colo")
+	for _, r := range results[:n] {
+		fmt.Printf("%-40s%-6d%-10d%-11.2f%-15.2f%-15.2f%s\n", r.IP, r.Sent, r.Received, r.LossRate(),
+			float64(r.Latency)/float64(time.Millisecond), r.DownloadSpeed/1024/1024, r.Colo)
+	}
+	if utils.Output != "" {
+		fmt.Printf("\nComplete test results have been written to %v file.\n", utils.Output)
+	}
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestScannerBackends(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"static list", map[string]string{"SCAN_BACKEND": "static", "SCAN_STATIC_IPS": "1.1.1.1, 2.2.2.2"}, "1.1.1.1,2.2.2.2"},
+		{"command csv", map[string]string{"SCAN_BACKEND": "command", "SCAN_COMMAND": `printf 'IP Address,Sent,Received,Loss Rate,Average Delay,Download Speed (MB/s)\n3.3.3.3,4,4,0.00,90.00,0.00\n4.4.4.4,4,4,0.00,40.00,0.00\n'`}, "4.4.4.4,3.3.3.3"},
+		{"command json", map[string]string{"SCAN_BACKEND": "command", "SCAN_COMMAND": `echo '[{"ip":"5.5.5.5","download_mbps":1},{"ip":"6.6.6.6","download_mbps":3}]'`}, "6.6.6.6,5.5.5.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env["SCAN_BACKEND"] == "command" && runtime.GOOS == "windows" {
+				t.Skip("needs a POSIX shell")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			s, err := scannerFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := s.Scan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sortScanResults(results)
+			var ips []string
+			for _, r := range results {
+				ips = append(ips, r.IP)
+			}
+			if got := strings.Join(ips, ","); got != tt.want {
+				t.Errorf("ips = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScannerUnknownBackend(t *testing.T) {
+	t.Setenv("SCAN_BACKEND", "bogus")
+	if _, err := scannerFromEnv(); err == nil {
+		t.Fatal("expected an error for an unknown backend")
+	}
+}
@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The history database keeps every scan cycle so generate can rank IPs by
+// long-term behaviour instead of one lucky scan. Layout:
+//
+//	cycles/<cycle>        -> number of IPs found in that cycle
+//	ips/<ip>/<cycle>      -> ipObservation JSON
+//
+// where <cycle> is the cycle start as 8 big-endian bytes of Unix nanoseconds.
+// Only the cycles of the scoring window (HISTORY_WINDOW) are kept. An IP has
+// observations only for the cycles that probed it; they are not OK when the
+// scan missed it or verify rejected it.
+var (
+	cyclesBucket = []byte("cycles")
+	ipsBucket    = []byte("ips")
+)
+
+// ipObservation is what one cycle saw of one IP.
+type ipObservation struct {
+	OK          bool    `json:"ok"`
+	Colo        string  `json:"colo,omitempty"`
+	LatencyMS   float64 `json:"latency_ms"`
+	SpeedMBps   float64 `json:"speed_mbps,omitempty"`
+	HandshakeMS float64 `json:"handshake_ms,omitempty"`
+}
+
+// ipScore summarises an IP over the scoring window.
+type ipScore struct {
+	IP   string
+	Colo string
+	// Cycles is how many window cycles probed the IP; Successes how many
+	// of them found it working.
+	Cycles    int
+	Successes int
+	// LatencyEWMA is the exponentially weighted latency of successful cycles.
+	LatencyEWMA float64
+	Score       float64
+}
+
+var scoresCmd = &cobra.Command{
+	Use:   "scores",
+	Short: "List IPs from the scan history database ranked by long-term score",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := openHistoryDB()
+		if err != nil {
+			return err
+		}
+		if db == nil {
+			return fmt.Errorf("HISTORY_DB is off")
+		}
+		defer db.Close()
+		scores, err := rankIPs(db, envInt("HISTORY_WINDOW", 10), envFloat("HISTORY_ALPHA", 0.3))
+		if err != nil {
+			return err
+		}
+		n, _ := cmd.Flags().GetInt("top")
+		fmt.Printf("%-40s%-6s%-9s%-13s%s\n", "IP Address", "Colo", "Success", "EWMA (ms)", "Score")
+		for i, s := range scores {
+			if n > 0 && i >= n {
+				break
+			}
+			fmt.Printf("%-40s%-6s%-9s%-13.2f%.4f\n", s.IP, s.Colo, fmt.Sprintf("%d/%d", s.Successes, s.Cycles), s.LatencyEWMA, s.Score)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scoresCmd)
+	scoresCmd.Flags().IntP("top", "n", 20, "Number of IPs to list (0 = all)")
+}
+
+// openHistoryDB opens HISTORY_DB (default scan-history.db in WORK_DIR). It
+// returns a nil DB without error when HISTORY_DB is "off".
+func openHistoryDB() (*bolt.DB, error) {
+	path := envStr("HISTORY_DB", "scan-history.db")
+	if strings.EqualFold(path, "off") {
+		return nil, nil
+	}
+	path = workPath(path)
+	if err := ensureDir(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("history db %s: %w", path, err)
+	}
+	return db, nil
+}
+
+func cycleKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
+
+func observationFrom(r ScanResult) ipObservation {
+	return ipObservation{
+		OK:          true,
+		Colo:        r.Colo,
+		LatencyMS:   float64(r.Latency) / float64(time.Millisecond),
+		SpeedMBps:   r.DownloadSpeed / 1024 / 1024,
+		HandshakeMS: float64(r.Handshake) / float64(time.Millisecond),
+	}
+}
+
+// recordCycle stores the results of one scan cycle started at start, then
+// drops all but the newest keep cycles (keep <= 0 keeps everything). IPs in
+// probed but not in results are recorded as not OK if they have history;
+// unknown IPs that did not answer are not worth a bucket.
+func recordCycle(db *bolt.DB, start time.Time, results []ScanResult, probed []string, keep int) error {
+	key := cycleKey(start)
+	return db.Update(func(tx *bolt.Tx) error {
+		cycles, err := tx.CreateBucketIfNotExists(cyclesBucket)
+		if err != nil {
+			return err
+		}
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(results)))
+		if err := cycles.Put(key, n[:]); err != nil {
+			return err
+		}
+		ips, err := tx.CreateBucketIfNotExists(ipsBucket)
+		if err != nil {
+			return err
+		}
+		found := make(map[string]bool, len(results))
+		for _, r := range results {
+			found[r.IP] = true
+			b, err := ips.CreateBucketIfNotExists([]byte(r.IP))
+			if err != nil {
+				return err
+			}
+			data, _ := json.Marshal(observationFrom(r))
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+		missed, _ := json.Marshal(ipObservation{})
+		for _, ip := range probed {
+			if b := ips.Bucket([]byte(ip)); b != nil && !found[ip] {
+				if err := b.Put(key, missed); err != nil {
+					return err
+				}
+			}
+		}
+		return pruneCycles(cycles, ips, keep)
+	})
+}
+
+// pruneCycles deletes the cycles older than the newest keep, their
+// observations, and IPs left without any.
+func pruneCycles(cycles, ips *bolt.Bucket, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	c := cycles.Cursor()
+	k, _ := c.Last()
+	for i := 1; k != nil && i < keep; i++ {
+		k, _ = c.Prev()
+	}
+	if k == nil {
+		return nil
+	}
+	oldest := append([]byte(nil), k...)
+	for k, _ := c.First(); k != nil && bytes.Compare(k, oldest) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	var empty [][]byte
+	err := ips.ForEachBucket(func(ip []byte) error {
+		c := ips.Bucket(ip).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, oldest) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		if k, _ := c.First(); k == nil {
+			empty = append(empty, append([]byte(nil), ip...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ip := range empty {
+		if err := ips.DeleteBucket(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// amendLatestCycle overwrites the latest cycle's observations: passed IPs
+// get their handshake time, failed ones are marked not OK.
+func amendLatestCycle(db *bolt.DB, passed []ScanResult, failed []string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		cycles, ips := tx.Bucket(cyclesBucket), tx.Bucket(ipsBucket)
+		if cycles == nil || ips == nil {
+			return nil
+		}
+		key, _ := cycles.Cursor().Last()
+		if key == nil {
+			return nil
+		}
+		for _, r := range passed {
+			b, err := ips.CreateBucketIfNotExists([]byte(r.IP))
+			if err != nil {
+				return err
+			}
+			data, _ := json.Marshal(observationFrom(r))
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+		for _, ip := range failed {
+			b, err := ips.CreateBucketIfNotExists([]byte(ip))
+			if err != nil {
+				return err
+			}
+			obs := ipObservation{}
+			if old := b.Get(key); old != nil {
+				_ = json.Unmarshal(old, &obs)
+			}
+			obs.OK = false
+			data, _ := json.Marshal(obs)
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rankIPs scores every IP seen in the last window cycles, best first. Only
+// cycles that probed an IP count for it, so random sampling that skipped it
+// is no failure. IPs that failed the latest cycle are left out: a good past
+// must not deploy an IP that is down now.
+func rankIPs(db *bolt.DB, window int, alpha float64) ([]ipScore, error) {
+	window = max(window, 1)
+	var scores []ipScore
+	err := db.View(func(tx *bolt.Tx) error {
+		cycles, ips := tx.Bucket(cyclesBucket), tx.Bucket(ipsBucket)
+		if cycles == nil || ips == nil {
+			return nil
+		}
+		// Window cycle keys, oldest first.
+		var keys [][]byte
+		c := cycles.Cursor()
+		for k, _ := c.Last(); k != nil && len(keys) < window; k, _ = c.Prev() {
+			keys = append([][]byte{append([]byte(nil), k...)}, keys...)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		latest := keys[len(keys)-1]
+		return ips.ForEachBucket(func(ip []byte) error {
+			b := ips.Bucket(ip)
+			s := ipScore{IP: string(ip), LatencyEWMA: -1}
+			for _, k := range keys {
+				data := b.Get(k)
+				if data == nil {
+					continue
+				}
+				var obs ipObservation
+				if err := json.Unmarshal(data, &obs); err != nil {
+					continue
+				}
+				s.Cycles++
+				if obs.Colo != "" {
+					s.Colo = obs.Colo
+				}
+				if !obs.OK {
+					if bytes.Equal(k, latest) {
+						return nil
+					}
+					continue
+				}
+				s.Successes++
+				if s.LatencyEWMA < 0 {
+					s.LatencyEWMA = obs.LatencyMS
+				} else {
+					s.LatencyEWMA = alpha*obs.LatencyMS + (1-alpha)*s.LatencyEWMA
+				}
+			}
+			if s.Successes == 0 {
+				return nil
+			}
+			s.Score = scoreIP(s)
+			scores = append(scores, s)
+			return nil
+		})
+	})
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	return scores, err
+}
+
+// scoreIP favours reliability first and latency second: the success ratio
+// (with a one-failure prior, so few sightings score lower) divided by a
+// latency penalty of 1 per second.
+func scoreIP(s ipScore) float64 {
+	ratio := float64(s.Successes) / float64(s.Cycles+1)
+	return ratio / (1 + math.Max(s.LatencyEWMA, 0)/1000)
+}
+
+// amendScanHistory applies verify's outcome to the latest cycle, if enabled.
+func amendScanHistory(passed []ScanResult, failed []string) error {
+	db, err := openHistoryDB()
+	if err != nil || db == nil {
+		return err
+	}
+	defer db.Close()
+	return amendLatestCycle(db, passed, failed)
+}
+
+// recordScanHistory appends a finished scan to the history database, if
+// enabled. probed lists the IPs the scan tried, when the backend knows.
+func recordScanHistory(start time.Time, results []ScanResult, probed []string) error {
+	db, err := openHistoryDB()
+	if err != nil || db == nil {
+		return err
+	}
+	defer db.Close()
+	return recordCycle(db, start, results, probed, envInt("HISTORY_WINDOW", 10))
+}
+
+// rankedIPsFromHistory returns every IP in the history window, best first.
+func rankedIPsFromHistory() ([]ipScore, error) {
+	db, err := openHistoryDB()
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return nil, fmt.Errorf("GENERATE_RANK=score needs HISTORY_DB")
+	}
+	defer db.Close()
+	return rankIPs(db, envInt("HISTORY_WINDOW", 10), envFloat("HISTORY_ALPHA", 0.3))
+}
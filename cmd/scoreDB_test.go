@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRankIPsPrefersConsistentIPs(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "history.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	start := time.Unix(1700000000, 0)
+	cycles := [][]ScanResult{
+		{{IP: "1.1.1.1", Latency: ms(120)}, {IP: "2.2.2.2", Latency: ms(20)}},
+		{{IP: "1.1.1.1", Latency: ms(110)}},
+		{{IP: "1.1.1.1", Latency: ms(130)}, {IP: "2.2.2.2", Latency: ms(15)}, {IP: "3.3.3.3", Latency: ms(5)}},
+	}
+	for i, results := range cycles {
+		// The second cycle probed 2.2.2.2 and missed it.
+		probed := []string{"1.1.1.1", "2.2.2.2"}
+		if err := recordCycle(db, start.Add(time.Duration(i)*time.Hour), results, probed, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// verify rejected 3.3.3.3 in the latest cycle.
+	if err := amendLatestCycle(db, nil, []string{"3.3.3.3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	scores, err := rankIPs(db, 10, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 2 {
+		t.Fatalf("got %d scored IPs, want 2 (3.3.3.3 never succeeded): %+v", len(scores), scores)
+	}
+	if scores[0].IP != "1.1.1.1" || scores[0].Successes != 3 || scores[0].Cycles != 3 {
+		t.Errorf("best = %+v, want 1.1.1.1 with 3/3", scores[0])
+	}
+	if scores[1].IP != "2.2.2.2" || scores[1].Successes != 2 || scores[1].Cycles != 3 {
+		t.Errorf("second = %+v, want 2.2.2.2 with 2/3", scores[1])
+	}
+
+	// A window of one cycle only sees the latest scan.
+	scores, _ = rankIPs(db, 1, 0.3)
+	if len(scores) != 2 || scores[0].IP != "2.2.2.2" {
+		t.Errorf("window=1 ranking = %+v, want 2.2.2.2 first", scores)
+	}
+}
+
+func TestRankIPsCountsProbedCyclesAndDropsLatestFailures(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "history.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	start := time.Unix(1700000000, 0)
+	ok := func(ips ...string) []ScanResult {
+		var rs []ScanResult
+		for _, ip := range ips {
+			rs = append(rs, ScanResult{IP: ip, Latency: 50 * time.Millisecond})
+		}
+		return rs
+	}
+	cycles := []struct {
+		results []ScanResult
+		probed  []string
+	}{
+		// 1.1.1.1 has a long good record; 2.2.2.2 is found whenever probed
+		// but random sampling skips it twice; 3.3.3.3 is probed and missed
+		// once. 9.9.9.9 is probed but never answers.
+		{ok("1.1.1.1", "2.2.2.2", "3.3.3.3"), []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "9.9.9.9"}},
+		{ok("1.1.1.1"), []string{"1.1.1.1", "3.3.3.3", "9.9.9.9"}},
+		{ok("1.1.1.1", "3.3.3.3"), []string{"1.1.1.1", "3.3.3.3"}},
+		{ok("1.1.1.1", "2.2.2.2", "3.3.3.3"), []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "9.9.9.9"}},
+	}
+	for i, c := range cycles {
+		if err := recordCycle(db, start.Add(time.Duration(i)*time.Hour), c.results, c.probed, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// verify rejected 1.1.1.1 in the latest cycle.
+	if err := amendLatestCycle(db, nil, []string{"1.1.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	scores, err := rankIPs(db, 10, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]ipScore{}
+	for _, s := range scores {
+		got[s.IP] = s
+	}
+	if _, ok := got["1.1.1.1"]; ok {
+		t.Errorf("1.1.1.1 failed the latest cycle but was ranked: %+v", scores)
+	}
+	if s := got["2.2.2.2"]; s.Successes != 2 || s.Cycles != 2 {
+		t.Errorf("2.2.2.2 = %+v, want 2/2 (unprobed cycles do not count)", s)
+	}
+	if s := got["3.3.3.3"]; s.Successes != 3 || s.Cycles != 4 {
+		t.Errorf("3.3.3.3 = %+v, want 3/4", s)
+	}
+	if len(scores) != 2 || scores[0].IP != "2.2.2.2" {
+		t.Errorf("ranking = %+v, want 2.2.2.2 then 3.3.3.3", scores)
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(ipsBucket).Bucket([]byte("9.9.9.9")) != nil {
+			t.Error("an IP that never answered got a history bucket")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordCycleKeepsOnlyTheWindow(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "history.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	start := time.Unix(1700000000, 0)
+	for i := range 5 {
+		// 9.9.9.9 is only seen in the first cycle; 1.1.1.1 in every one.
+		results := []ScanResult{{IP: "1.1.1.1", Latency: time.Duration(10+i) * time.Millisecond}}
+		if i == 0 {
+			results = append(results, ScanResult{IP: "9.9.9.9", Latency: time.Millisecond})
+		}
+		if err := recordCycle(db, start.Add(time.Duration(i)*time.Hour), results, nil, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(cyclesBucket).Stats().KeyN; n != 3 {
+			t.Errorf("cycles kept = %d, want 3", n)
+		}
+		ips := tx.Bucket(ipsBucket)
+		if ips.Bucket([]byte("9.9.9.9")) != nil {
+			t.Error("IP without samples in the window was kept")
+		}
+		b := ips.Bucket([]byte("1.1.1.1"))
+		if b == nil {
+			t.Fatal("1.1.1.1 was dropped")
+		}
+		if n := b.Stats().KeyN; n != 3 {
+			t.Errorf("1.1.1.1 observations = %d, want 3", n)
+		}
+		if b.Get(cycleKey(start.Add(time.Hour))) != nil || b.Get(cycleKey(start.Add(2*time.Hour))) == nil {
+			t.Error("pruned the wrong observations")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scores, err := rankIPs(db, 10, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 1 || scores[0].IP != "1.1.1.1" || scores[0].Cycles != 3 {
+		t.Errorf("scores after pruning = %+v", scores)
+	}
+}
@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A template may carry a "meta" block, which is not part of the output:
+//
+//	"meta": {
+//	  "id": "de-ws",               // identifies the template in tags; default: file name
+//	  "name": "Germany WS",        // shown in logs and {name}; default: file name
+//	  "enabled": false,            // keep the file but do not deploy it
+//	  "maxIPs": 5,                 // use at most this many IPs (0 = all)
+//	  "ipFamily": "v4",            // v4, v6 or mixed (default)
+//	  "colos": ["FRA", "AMS"],     // only IPs scanned in these colos
+//	  "tag": "{prefix}{name}-{ip}" // tag pattern, see templateTag
+//	}
+//
+// A template may also declare a matrix that generate expands into one variant
+// per port and SNI, instead of one template file per variant:
+//
+//	"matrix": {"ports": [443, 2053, 8443], "sni": ["a.example.com", "b.example.com"]}
+//
+// A port replaces the server port; an SNI replaces tlsSettings.serverName
+// and the transport's host, or realitySettings.serverName for REALITY. The
+// matrix key itself is not part of the output.
+
+// templateMeta is a template's "meta" block.
+type templateMeta struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Enabled  *bool    `json:"enabled"`
+	MaxIPs   int      `json:"maxIPs"`
+	IPFamily string   `json:"ipFamily"`
+	Colos    []string `json:"colos"`
+	Tag      string   `json:"tag"`
+}
+
+// outboundTemplate is one outbound template, or one matrix variant of it.
+type outboundTemplate struct {
+	File   string
+	Meta   templateMeta
+	Config map[string]interface{}
+	// Port and SNI are the matrix values this variant was built with (zero
+	// when the template has no matrix); they are appended to the tag.
+	Port int
+	SNI  string
+}
+
+// tagSuffix is what distinguishes this variant's tags from its siblings'.
+func (t outboundTemplate) tagSuffix() string {
+	s := ""
+	if t.Port != 0 {
+		s += "-" + strconv.Itoa(t.Port)
+	}
+	if t.SNI != "" {
+		s += "-" + t.SNI
+	}
+	return s
+}
+
+// variant names this template variant in verify's results: the file plus
+// the tag suffix.
+func (t outboundTemplate) variant() string {
+	return t.File + t.tagSuffix()
+}
+
+type templateMatrix struct {
+	Ports []int    `json:"ports"`
+	SNI   []string `json:"sni"`
+}
+
+func readConfigs(dir string) ([]outboundTemplate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var templates []outboundTemplate
+	seen := map[string]bool{}
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		n++
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var cfg map[string]interface{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		if errs := validateTemplate(e.Name(), cfg); len(errs) > 0 {
+			return nil, templateErrors(errs)
+		}
+		meta, err := parseTemplateMeta(e.Name(), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		if meta.Enabled != nil && !*meta.Enabled {
+			continue
+		}
+		variants, err := expandMatrix(e.Name(), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		// The same combination declared twice in a matrix would produce
+		// duplicate outbounds; keep the first.
+		for _, v := range variants {
+			v.Meta = meta
+			key, _ := json.Marshal([]interface{}{v.File, v.Config})
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			templates = append(templates, v)
+		}
+	}
+	// Without templates generate would write no outbounds, and update would
+	// then remove every prefixed outbound from the panel.
+	switch {
+	case n == 0:
+		return nil, templateError{File: dir, Msg: "no .json templates"}
+	case len(templates) == 0:
+		return nil, templateError{File: dir, Msg: "every template is disabled"}
+	}
+	return templates, nil
+}
+
+// parseTemplateMeta removes the "meta" block from cfg and returns it with
+// defaults filled in.
+func parseTemplateMeta(file string, cfg map[string]interface{}) (templateMeta, error) {
+	var meta templateMeta
+	if raw, ok := cfg["meta"]; ok {
+		delete(cfg, "meta")
+		data, _ := json.Marshal(raw)
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return meta, fmt.Errorf("meta: %w", err)
+		}
+	}
+	stem := strings.TrimSuffix(file, filepath.Ext(file))
+	if meta.Name == "" {
+		meta.Name = stem
+	}
+	meta.ID = tagSlug(firstNonEmpty(meta.ID, stem))
+	for i, c := range meta.Colos {
+		meta.Colos[i] = strings.ToUpper(strings.TrimSpace(c))
+	}
+	return meta, nil
+}
+
+// accepts reports whether the template may be used with an IP of colo
+// (empty when unknown). Only the family and colo filters are checked here;
+// MaxIPs depends on what was already generated.
+func (m templateMeta) accepts(ip netip.Addr, colo string) bool {
+	switch strings.ToLower(m.IPFamily) {
+	case "v4":
+		if !ip.Unmap().Is4() {
+			return false
+		}
+	case "v6":
+		if ip.Unmap().Is4() {
+			return false
+		}
+	}
+	return len(m.Colos) == 0 || slices.Contains(m.Colos, colo)
+}
+
+// tagSlug lowercases s and replaces anything but letters, digits and
+// dashes, so file names like "DE origin.json" make usable tag parts.
+func tagSlug(s string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, s), "-")
+}
+
+// id is what tags use to tell templates apart: the meta id (by default the
+// file name), or the protocol for a template not read from a file.
+func (t outboundTemplate) id() string {
+	if t.Meta.ID != "" {
+		return t.Meta.ID
+	}
+	p, _ := t.Config["protocol"].(string)
+	return p
+}
+
+// templateTag expands a meta tag pattern. Placeholders: {prefix}, {id},
+// {protocol}, {name}, {ip} (IPv6 colons as dashes), {colo}, {port}, {sni}.
+func templateTag(t outboundTemplate, protocol, ip, colo string) string {
+	port := ""
+	if t.Port != 0 {
+		port = strconv.Itoa(t.Port)
+	} else if _, p := outboundServer(t.Config); p != 0 {
+		port = strconv.Itoa(p)
+	}
+	return strings.NewReplacer(
+		"{prefix}", outboundPrefix(),
+		"{id}", t.id(),
+		"{protocol}", protocol,
+		"{name}", t.Meta.Name,
+		"{ip}", tagIP(ip),
+		"{colo}", colo,
+		"{port}", port,
+		"{sni}", t.SNI,
+	).Replace(t.Meta.Tag)
+}
+
+// expandMatrix returns the variants of cfg declared by its "matrix" key,
+// or cfg alone when there is none.
+func expandMatrix(file string, cfg map[string]interface{}) ([]outboundTemplate, error) {
+	raw, ok := cfg["matrix"]
+	if !ok {
+		return []outboundTemplate{{File: file, Config: cfg}}, nil
+	}
+	delete(cfg, "matrix")
+	data, _ := json.Marshal(raw)
+	var m templateMatrix
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("matrix: %w", err)
+	}
+	ports, snis := m.Ports, m.SNI
+	if len(ports) == 0 {
+		ports = []int{0}
+	}
+	if len(snis) == 0 {
+		snis = []string{""}
+	}
+	var variants []outboundTemplate
+	for _, port := range ports {
+		for _, sni := range snis {
+			v, err := deepCopyMap(cfg)
+			if err != nil {
+				return nil, err
+			}
+			if port != 0 {
+				setServerField(v, "port", port)
+			}
+			if sni != "" {
+				setSNI(v, sni)
+			}
+			variants = append(variants, outboundTemplate{File: file, Config: v, Port: port, SNI: sni})
+		}
+	}
+	return variants, nil
+}
+
+func deepCopyMap(m map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// setServerField sets key on every server of a trojan or vless outbound.
+func setServerField(ob map[string]interface{}, key string, value interface{}) {
+	settings, _ := ob["settings"].(map[string]interface{})
+	var servers []interface{}
+	switch ob["protocol"] {
+	case "trojan":
+		servers, _ = settings["servers"].([]interface{})
+	case "vless":
+		servers, _ = settings["vnext"].([]interface{})
+	}
+	for _, s := range servers {
+		if m, ok := s.(map[string]interface{}); ok {
+			m[key] = value
+		}
+	}
+}
+
+// setSNI sets the server name of the outbound's security layer. With TLS
+// it also sets the host of whichever transport the outbound uses; REALITY
+// only takes realitySettings.serverName. validate rejects an SNI matrix
+// without either.
+func setSNI(ob map[string]interface{}, sni string) {
+	ss, _ := ob["streamSettings"].(map[string]interface{})
+	if ss == nil {
+		return
+	}
+	key := "tlsSettings"
+	security, _ := ss["security"].(string)
+	switch security {
+	case "tls":
+	case "reality":
+		key = "realitySettings"
+	default:
+		return
+	}
+	settings, _ := ss[key].(map[string]interface{})
+	if settings == nil {
+		settings = map[string]interface{}{}
+		ss[key] = settings
+	}
+	settings["serverName"] = sni
+	if security == "reality" {
+		return
+	}
+
+	network, _ := ss["network"].(string)
+	switch network {
+	case "ws":
+		ws, _ := ss["wsSettings"].(map[string]interface{})
+		if ws == nil {
+			ws = map[string]interface{}{}
+			ss["wsSettings"] = ws
+		}
+		ws["host"] = sni
+		if headers, ok := ws["headers"].(map[string]interface{}); ok {
+			if _, ok := headers["Host"]; ok {
+				headers["Host"] = sni
+			}
+		}
+	case "httpupgrade", "xhttp", "splithttp":
+		key := network + "Settings"
+		t, _ := ss[key].(map[string]interface{})
+		if t == nil {
+			t = map[string]interface{}{}
+			ss[key] = t
+		}
+		t["host"] = sni
+	case "grpc":
+		if g, ok := ss["grpcSettings"].(map[string]interface{}); ok {
+			if _, ok := g["authority"]; ok {
+				g["authority"] = sni
+			}
+		}
+	}
+}
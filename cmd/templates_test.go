@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetSNIFollowsSecurity(t *testing.T) {
+	reality := map[string]interface{}{"streamSettings": map[string]interface{}{
+		"network": "grpc", "security": "reality",
+		"realitySettings": map[string]interface{}{"serverName": "old", "publicKey": "k"},
+	}}
+	setSNI(reality, "a.example.com")
+	ss := reality["streamSettings"].(map[string]interface{})
+	if got := ss["realitySettings"].(map[string]interface{})["serverName"]; got != "a.example.com" {
+		t.Errorf("reality serverName = %v", got)
+	}
+	if _, ok := ss["tlsSettings"]; ok {
+		t.Error("tlsSettings added to a REALITY outbound")
+	}
+
+	tls := map[string]interface{}{"streamSettings": map[string]interface{}{"network": "ws", "security": "tls"}}
+	setSNI(tls, "b.example.com")
+	ss = tls["streamSettings"].(map[string]interface{})
+	if ss["tlsSettings"].(map[string]interface{})["serverName"] != "b.example.com" || ss["wsSettings"].(map[string]interface{})["host"] != "b.example.com" {
+		t.Errorf("tls stream = %v", ss)
+	}
+}
+
+func TestReadConfigsExpandsMatrix(t *testing.T) {
+	dir := t.TempDir()
+	vless := `{
+  "protocol": "vless",
+  "matrix": {"ports": [443, 2053, 443], "sni": ["a.example.com", "b.example.com"]},
+  "settings": {"vnext": [{"address": "0.0.0.0", "port": 443, "users": [{"id": "x"}]}]},
+  "streamSettings": {"network": "ws", "security": "tls", "wsSettings": {"path": "/", "headers": {"Host": "old"}}}
+}`
+	if err := os.WriteFile(filepath.Join(dir, "vless.json"), []byte(vless), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OUTBOUND_PREFIX", "")
+
+	templates, err := readConfigs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, tpl := range templates {
+		if _, ok := tpl.Config["matrix"]; ok {
+			t.Fatal("matrix key left in the template")
+		}
+		ob, err := cloneAndSetAddress(tpl, "1.2.3.4", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, ob["tag"].(string))
+		addr, port := outboundServer(ob)
+		if addr != "1.2.3.4" || port != tpl.Port {
+			t.Errorf("%s: server %s:%d", ob["tag"], addr, port)
+		}
+		ss := ob["streamSettings"].(map[string]interface{})
+		ws := ss["wsSettings"].(map[string]interface{})
+		if sni := ss["tlsSettings"].(map[string]interface{})["serverName"]; sni != tpl.SNI || ws["host"] != tpl.SNI || ws["headers"].(map[string]interface{})["Host"] != tpl.SNI {
+			t.Errorf("%s: SNI/host not set to %s", ob["tag"], tpl.SNI)
+		}
+	}
+	want := "cf-clean-vless-1.2.3.4-443-a.example.com,cf-clean-vless-1.2.3.4-443-b.example.com," +
+		"cf-clean-vless-1.2.3.4-2053-a.example.com,cf-clean-vless-1.2.3.4-2053-b.example.com"
+	if got := strings.Join(tags, ","); got != want {
+		t.Errorf("tags = %s, want %s", got, want)
+	}
+}
+
+func TestRunGenerateTemplateMeta(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("configs", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	templates := map[string]string{
+		"a.json": `{"protocol": "trojan", "meta": {"name": "fra", "colos": ["fra"], "tag": "{prefix}{name}-{colo}-{ip}-{port}"},
+			"settings": {"servers": [{"port": 2053, "password": "p"}]}}`,
+		"b.json": `{"protocol": "trojan", "meta": {"maxIPs": 2, "ipFamily": "v4"}, "settings": {"servers": [{"port": 443, "password": "p"}]}}`,
+		"c.json": `{"protocol": "trojan", "meta": {"enabled": false}, "settings": {"servers": [{"port": 8443, "password": "p"}]}}`,
+	}
+	for name, data := range templates {
+		if err := os.WriteFile(filepath.Join("configs", name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("SCAN_O", "result.csv")
+	err := writeScanCSV(scanOutputPath(), []ScanResult{
+		{IP: "2606:4700::1", Colo: "FRA"}, {IP: "1.0.0.1", Colo: "AMS"}, {IP: "1.0.0.2", Colo: "FRA"}, {IP: "1.0.0.3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GENERATE_IP_FAMILY", "mixed")
+	t.Setenv("OUTBOUND_PREFIX", "")
+
+	if err := runGenerate(generateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(generatedOutboundsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outbounds []interface{}
+	if err := json.Unmarshal(data, &outbounds); err != nil {
+		t.Fatal(err)
+	}
+	want := "cf-clean-fra-FRA-2606-4700--1-2053,cf-clean-b-1.0.0.1,cf-clean-fra-FRA-1.0.0.2-2053,cf-clean-b-1.0.0.2"
+	if got := strings.Join(outboundTags(outbounds), ","); got != want {
+		t.Errorf("outbounds = %s, want %s", got, want)
+	}
+	for _, o := range outbounds {
+		if _, ok := o.(map[string]interface{})["meta"]; ok {
+			t.Fatal("meta block left in the output")
+		}
+	}
+}
+
+func TestRunGenerateDetectsDuplicateTags(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("configs", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	templates := map[string]string{
+		"Origin A.json": `{"protocol": "trojan", "settings": {"servers": [{"port": 443, "password": "a"}]}}`,
+		"origin-b.json": `{"protocol": "trojan", "meta": {"id": "origin-a"}, "settings": {"servers": [{"port": 443, "password": "b"}]}}`,
+		"origin-c.json": `{"protocol": "trojan", "settings": {"servers": [{"port": 443, "password": "c"}]}}`,
+	}
+	for name, data := range templates {
+		if err := os.WriteFile(filepath.Join("configs", name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("SCAN_O", "result.csv")
+	if err := writeScanCSV(scanOutputPath(), []ScanResult{{IP: "1.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OUTBOUND_PREFIX", "")
+
+	err := runGenerate(generateCmd, nil)
+	if err == nil {
+		t.Fatal("expected a duplicate tag error")
+	}
+	if want := "cf-clean-origin-a-1.0.0.1 (from Origin A.json, origin-b.json)"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %v, want it to mention %s", err, want)
+	}
+	if strings.Contains(err.Error(), "origin-c") {
+		t.Errorf("error = %v mentions a template without a conflict", err)
+	}
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SamMHD/cfscanner-to-3xui/internal/xuimock"
+)
+
+// RFC 6238 appendix B, SHA-1, truncated to 6 digits.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		got, err := totpCode(secret, time.Unix(tc.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("totpCode at %d = %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+	// Authenticator apps show seeds lower-case and grouped.
+	if got, _ := totpCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Unix(59, 0)); got != "287082" {
+		t.Errorf("spaced lower-case seed gave %s", got)
+	}
+	if _, err := totpCode("not base32!", time.Now()); err == nil {
+		t.Error("invalid seed accepted")
+	}
+}
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+func loginPanel(t *testing.T, creds xuiCredentials, setup func(*xuimock.Server)) (*xuimock.Server, error) {
+	t.Helper()
+	panel := xuimock.New("admin", "secret", panelXraySetting())
+	t.Cleanup(panel.Close)
+	setup(panel)
+	s, err := newPanelSession(panelOptions{BaseURL: panel.URL, Timeout: 5 * time.Second, Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds.Username, creds.Password = "admin", "secret"
+	return panel, s.login(creds)
+}
+
+// validTOTP accepts the code of the current or previous step, like panels do.
+func validTOTP(code string) bool {
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(-30 * time.Second)} {
+		if want, _ := totpCode(testTOTPSecret, at); code == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	panel, err := loginPanel(t, xuiCredentials{TwoFactorSecret: testTOTPSecret}, func(p *xuimock.Server) {
+		p.TwoFactor = validTOTP
+	})
+	if err != nil || panel.Logins != 1 {
+		t.Fatalf("login with 2FA: err=%v logins=%d", err, panel.Logins)
+	}
+
+	_, err = loginPanel(t, xuiCredentials{}, func(p *xuimock.Server) { p.TwoFactor = validTOTP })
+	if err == nil || !strings.Contains(err.Error(), "XUI_TWO_FACTOR_SECRET") {
+		t.Errorf("2FA panel without secret: err = %v", err)
+	}
+
+	_, err = loginPanel(t, xuiCredentials{TwoFactorSecret: "GEZDGNBVGY3TQOJQ"}, func(p *xuimock.Server) { p.TwoFactor = validTOTP })
+	if err == nil || !strings.Contains(err.Error(), "(password + two-factor code sent;") {
+		t.Errorf("wrong 2FA secret: err = %v", err)
+	}
+
+	// A login retried after a proxy error builds its form, code included,
+	// again and still gets in.
+	var codes int
+	panel, err = loginPanel(t, xuiCredentials{TwoFactorSecret: testTOTPSecret}, func(p *xuimock.Server) {
+		p.TwoFactor = func(code string) bool { codes++; return validTOTP(code) }
+		p.FailLogin, p.FailTimes = xuimock.BadGateway, 1
+	})
+	if err != nil || panel.Logins != 1 || codes != 1 {
+		t.Errorf("retried 2FA login: err=%v logins=%d codes checked=%d", err, panel.Logins, codes)
+	}
+}
+
+func TestLoginSecret(t *testing.T) {
+	panel, err := loginPanel(t, xuiCredentials{LoginSecret: "s3cret"}, func(p *xuimock.Server) { p.LoginSecret = "s3cret" })
+	if err != nil || panel.Logins != 1 {
+		t.Fatalf("login with secret: err=%v logins=%d", err, panel.Logins)
+	}
+
+	_, err = loginPanel(t, xuiCredentials{}, func(p *xuimock.Server) { p.LoginSecret = "s3cret" })
+	if err == nil || !strings.Contains(err.Error(), "XUI_LOGIN_SECRET") {
+		t.Errorf("secret panel without XUI_LOGIN_SECRET: err = %v", err)
+	}
+
+	_, err = loginPanel(t, xuiCredentials{LoginSecret: "wrong"}, func(p *xuimock.Server) { p.LoginSecret = "s3cret" })
+	if err == nil || !strings.Contains(err.Error(), "(password + login secret sent;") {
+		t.Errorf("wrong login secret: err = %v", err)
+	}
+}
@@ -1,13 +1,10 @@
 package cmd
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -15,6 +12,11 @@ import (
 
 const generatedOutboundsPath = "generated-outbounds.json"
 
+// applyPendingPath marks a config saved to the panel that Xray has not been
+// restarted or hot-applied with yet, so the next update applies it even when
+// the panel already holds it.
+const applyPendingPath = "xray-apply-pending"
+
 var updateCmd = &cobra.Command{
 	Use:   "update",
 	Short: "Fetch xray outbounds from 3x-ui panel and print to stdout",
@@ -25,244 +27,253 @@ func init() {
 	rootCmd.AddCommand(updateCmd)
 }
 
-func getToken(baseURL, username, password string, allowInsecure bool) string {
-	baseURL = strings.TrimRight(baseURL, "/")
-	loginURL := baseURL + "/login"
-
-	client := &http.Client{}
-	if allowInsecure {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+func runUpdate(cmd *cobra.Command, args []string) (err error) {
+	opts := panelOptionsFromEnv()
+	creds := xuiCredentials{
+		Username:        os.Getenv("XUI_USERNAME"),
+		Password:        os.Getenv("XUI_PASSWORD"),
+		TwoFactorSecret: os.Getenv("XUI_TWO_FACTOR_SECRET"),
+		LoginSecret:     os.Getenv("XUI_LOGIN_SECRET"),
 	}
+	prefix := outboundPrefix()
+	log := stageLog("update").With("panel", opts.BaseURL)
 
-	form := url.Values{}
-	form.Set("username", username)
-	form.Set("password", password)
-
-	req, err := http.NewRequest(http.MethodPost, loginURL, strings.NewReader(form.Encode()))
-	if err != nil {
-		panic(err)
+	if opts.BaseURL == "" || creds.Username == "" || creds.Password == "" {
+		return fmt.Errorf("XUI_URL, XUI_USERNAME, XUI_PASSWORD must be set")
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := client.Do(req)
+	// Check the generated file before touching the panel.
+	newOutbounds, err := readGeneratedOutbounds(workPath(generatedOutboundsPath), prefix)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	for _, line := range resp.Header["Set-Cookie"] {
-		if strings.HasPrefix(line, "3x-ui=") {
-			val := strings.TrimPrefix(line, "3x-ui=")
-			if i := strings.Index(val, ";"); i >= 0 {
-				val = val[:i]
-			}
-			return strings.TrimSpace(val)
+	if hotUpdate() {
+		if err := xrayAPIFromEnv().check(); err != nil {
+			return err
 		}
 	}
 
-	fmt.Println("Headers:")
-	for k, v := range resp.Header {
-		fmt.Printf("  %s: %s\n", k, strings.Join(v, ", "))
-	}
-	fmt.Println("Body:")
-	fmt.Println(string(body))
-	panic("3x-ui cookie not found in login response")
-}
-
-func xrayClient(allowInsecure bool) *http.Client {
-	client := &http.Client{}
-	if allowInsecure {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	push := panelPush{URL: opts.BaseURL, Outbounds: len(newOutbounds)}
+	defer func() {
+		if err != nil {
+			push.Error = err.Error()
 		}
-	}
-	return client
-}
-
-func getPanelConfig(baseURL, token string, allowInsecure bool) string {
-	baseURL = strings.TrimRight(baseURL, "/")
-	panelURL := baseURL + "/panel/xray/"
+		notePanelPush(push)
+	}()
 
-	req, err := http.NewRequest(http.MethodPost, panelURL, nil)
+	panel, err := newPanelSession(opts)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	req.Header.Set("Cookie", "3x-ui="+token)
-
-	resp, err := xrayClient(allowInsecure).Do(req)
+	if err := panel.login(creds); err != nil {
+		return err
+	}
+	obj, err := panel.getPanelConfig()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-
-	var wrapper struct {
-		Success bool   `json:"success"`
-		Msg     string `json:"msg"`
-		Obj     string `json:"obj"`
-	}
-	if err := json.Unmarshal(body, &wrapper); err != nil {
-		fmt.Println("Body:", string(body))
-		panic(err)
-	}
-	if !wrapper.Success {
-		fmt.Println("Body:", string(body))
-		panic("panel response success=false: " + wrapper.Msg)
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(obj), &config); err != nil {
+		log.Debug("undecodable xray config", "obj", redactBody([]byte(obj)))
+		return err
 	}
-	return wrapper.Obj
-}
 
-func getOutbounds(baseURL, token string, allowInsecure bool) []interface{} {
-	obj := getPanelConfig(baseURL, token, allowInsecure)
-	var xray struct {
-		XraySetting struct {
-			Outbounds []interface{} `json:"outbounds"`
-		} `json:"xraySetting"`
-	}
-	if err := json.Unmarshal([]byte(obj), &xray); err != nil {
-		fmt.Println("Obj:", obj)
-		panic(err)
+	xraySetting, _ := config["xraySetting"].(map[string]interface{})
+	if xraySetting == nil {
+		return fmt.Errorf("xraySetting not found in panel config")
 	}
-	return xray.XraySetting.Outbounds
-}
 
-func putPanelConfig(baseURL, token string, xraySetting map[string]interface{}, allowInsecure bool) {
-	baseURL = strings.TrimRight(baseURL, "/")
-	panelURL := baseURL + "/panel/xray/update"
-
-	xrayJSON, err := json.Marshal(xraySetting)
-	if err != nil {
-		panic(err)
+	existing, _ := xraySetting["outbounds"].([]interface{})
+	var outbounds []interface{}
+	for _, o := range existing {
+		ob, _ := o.(map[string]interface{})
+		if ob == nil {
+			outbounds = append(outbounds, o)
+			continue
+		}
+		tag, _ := ob["tag"].(string)
+		if strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		outbounds = append(outbounds, o)
 	}
 
-	form := url.Values{}
-	form.Set("xraySetting", string(xrayJSON))
+	outbounds = append(outbounds, newOutbounds...)
 
-	req, err := http.NewRequest(http.MethodPost, panelURL, strings.NewReader(form.Encode()))
-	if err != nil {
-		panic(err)
+	if err := checkDialerProxies(outbounds); err != nil {
+		return err
 	}
-	req.Header.Set("Cookie", "3x-ui="+token)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
-
-	resp, err := xrayClient(allowInsecure).Do(req)
-	if err != nil {
-		panic(err)
+	before := canonicalSet(existing, currentBalancers(xraySetting))
+	balancersBefore := canonicalSet(nil, currentBalancers(xraySetting))
+	xraySetting["outbounds"] = outbounds
+	if err := mergeBalancers(xraySetting, prefix); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	bodyStr := strings.TrimSpace(string(body))
-	if len(bodyStr) == 0 {
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			return
+	pendingPath := workPath(applyPendingPath)
+	_, perr := os.Stat(pendingPath)
+	pending := perr == nil
+	want := canonicalSet(outbounds, currentBalancers(xraySetting))
+	switch {
+	case want == before && !pending:
+		// Restarting Xray drops every live connection; avoid it when the
+		// deployed outbounds are already what we would push.
+		push.Restart = "skipped"
+		log.Info("no changes; skipping panel update and Xray restart")
+		return nil
+	case want == before:
+		// Nothing to diff against: the running Xray may hold any older config.
+		log.Warn("panel config was saved but never applied; restarting Xray")
+	default:
+		if err := ensureDir(pendingPath); err != nil {
+			return err
 		}
-		panic(fmt.Sprintf("panel update status %d with empty body", resp.StatusCode))
-	}
-	var wrapper struct {
-		Success bool   `json:"success"`
-		Msg     string `json:"msg"`
+		if err := os.WriteFile(pendingPath, []byte(sha256Hex([]byte(want))+"\n"), 0o644); err != nil {
+			return err
+		}
+		if err := panel.putPanelConfig(xraySetting); err != nil {
+			return err
+		}
+		push.Updated = true
 	}
-	if err := json.Unmarshal(body, &wrapper); err != nil {
-		fmt.Println("Body:", string(body))
-		panic(err)
+	defer func() {
+		if err == nil {
+			err = os.Remove(pendingPath)
+		}
+	}()
+	if hotUpdate() && push.Updated {
+		// Balancers live in routing, which the API cannot change in place.
+		switch {
+		case !handlerServiceEnabled(xraySetting):
+			log.Warn("Xray API HandlerService is not enabled in the panel config; restarting instead")
+		case canonicalSet(nil, currentBalancers(xraySetting)) != balancersBefore:
+			log.Info("routing balancers changed; restarting instead of hot-applying")
+		default:
+			herr := hotApply(xrayAPIFromEnv(), existing, outbounds, prefix)
+			if herr == nil {
+				push.Restart = "hot"
+				log.Info("outbounds hot-applied", "outbounds", len(newOutbounds))
+				return nil
+			}
+			log.Warn("hot-apply failed; restarting instead", "err", herr)
+		}
 	}
-	if !wrapper.Success {
-		fmt.Println("Body:", string(body))
-		panic("panel update success=false: " + wrapper.Msg)
+	if err := panel.restartXrayService(); err != nil {
+		push.Restart = "failed"
+		return err
 	}
+	push.Restart = "ok"
+	log.Info("panel updated and Xray restarted", "outbounds", len(newOutbounds))
+	return nil
 }
 
-func restartXrayService(baseURL, token string, allowInsecure bool) {
-	baseURL = strings.TrimRight(baseURL, "/")
-	restartURL := baseURL + "/panel/api/server/restartXrayService"
+func currentBalancers(xraySetting map[string]interface{}) []interface{} {
+	routing, _ := xraySetting["routing"].(map[string]interface{})
+	balancers, _ := routing["balancers"].([]interface{})
+	return balancers
+}
 
-	req, err := http.NewRequest(http.MethodPost, restartURL, nil)
-	if err != nil {
-		panic(err)
+// canonicalSet renders outbounds and balancers order-insensitively: each
+// entry as canonical JSON (encoding/json sorts object keys), sorted.
+func canonicalSet(outbounds, balancers []interface{}) string {
+	var parts []string
+	for _, group := range [][]interface{}{outbounds, balancers} {
+		entries := make([]string, 0, len(group))
+		for _, v := range group {
+			data, _ := json.Marshal(v)
+			entries = append(entries, string(data))
+		}
+		sort.Strings(entries)
+		parts = append(parts, strings.Join(entries, "\n"))
 	}
-	req.Header.Set("Cookie", "3x-ui="+token)
+	return strings.Join(parts, "\n--\n")
+}
 
-	resp, err := xrayClient(allowInsecure).Do(req)
+// readGeneratedOutbounds reads generate's output and makes sure it is a
+// complete JSON array of outbounds whose tags update will own.
+func readGeneratedOutbounds(path, prefix string) ([]interface{}, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	bodyStr := strings.TrimSpace(string(body))
-	if len(bodyStr) == 0 && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%s is not complete JSON; run generate again", path)
 	}
-	if len(bodyStr) > 0 {
-		var wrapper struct {
-			Success bool   `json:"success"`
-			Msg     string `json:"msg"`
-		}
-		if err := json.Unmarshal(body, &wrapper); err == nil && !wrapper.Success {
-			panic("restartXrayService success=false: " + wrapper.Msg)
+	var outbounds []interface{}
+	if err := json.Unmarshal(data, &outbounds); err != nil {
+		return nil, fmt.Errorf("%s: want a JSON array of outbounds: %w", path, err)
+	}
+	for i, o := range outbounds {
+		ob, _ := o.(map[string]interface{})
+		tag, _ := ob["tag"].(string)
+		if !strings.HasPrefix(tag, prefix) {
+			return nil, fmt.Errorf("%s: outbound %d tag %q does not start with OUTBOUND_PREFIX %q", path, i, tag, prefix)
 		}
 	}
+	return outbounds, nil
 }
 
-func runUpdate(cmd *cobra.Command, args []string) error {
-	baseURL := os.Getenv("XUI_URL")
-	username := os.Getenv("XUI_USERNAME")
-	password := os.Getenv("XUI_PASSWORD")
-	allowInsecure := os.Getenv("XUI_ALLOW_INSECURE") == "1" || strings.EqualFold(os.Getenv("XUI_ALLOW_INSECURE"), "true")
-	outboundPrefix := os.Getenv("OUTBOUND_PREFIX")
-
-	if baseURL == "" || username == "" || password == "" {
-		return fmt.Errorf("XUI_URL, XUI_USERNAME, XUI_PASSWORD must be set")
-	}
-
-	token := getToken(baseURL, username, password, allowInsecure)
-	obj := getPanelConfig(baseURL, token, allowInsecure)
-
-	var config map[string]interface{}
-	if err := json.Unmarshal([]byte(obj), &config); err != nil {
-		fmt.Println("Obj:", obj)
+// mergeBalancers replaces the prefixed routing balancers with those in
+// generated-balancers.json; without that file they are only removed.
+func mergeBalancers(xraySetting map[string]interface{}, prefix string) error {
+	path := workPath(generatedBalancersPath)
+	var generated []interface{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if !json.Valid(data) {
+			return fmt.Errorf("%s is not complete JSON; run generate again", path)
+		}
+		if err := json.Unmarshal(data, &generated); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
 		return err
 	}
-
-	xraySetting, _ := config["xraySetting"].(map[string]interface{})
-	if xraySetting == nil {
-		panic("xraySetting not found in panel config")
-	}
-
-	existing, _ := xraySetting["outbounds"].([]interface{})
-	var outbounds []interface{}
-	for _, o := range existing {
-		ob, _ := o.(map[string]interface{})
-		if ob == nil {
-			outbounds = append(outbounds, o)
-			continue
+	routing, _ := xraySetting["routing"].(map[string]interface{})
+	if routing == nil {
+		if len(generated) == 0 {
+			return nil
 		}
-		tag, _ := ob["tag"].(string)
-		if outboundPrefix != "" && strings.HasPrefix(tag, outboundPrefix) {
-			continue
+		routing = map[string]interface{}{}
+		xraySetting["routing"] = routing
+	}
+	existing, _ := routing["balancers"].([]interface{})
+	var balancers []interface{}
+	for _, b := range existing {
+		if m, ok := b.(map[string]interface{}); ok {
+			if tag, _ := m["tag"].(string); strings.HasPrefix(tag, prefix) {
+				continue
+			}
 		}
-		outbounds = append(outbounds, o)
+		balancers = append(balancers, b)
 	}
+	balancers = append(balancers, generated...)
+	if len(balancers) == 0 {
+		delete(routing, "balancers")
+	} else {
+		routing["balancers"] = balancers
+	}
+	return nil
+}
 
-	generated, err := os.ReadFile(generatedOutboundsPath)
-	if err != nil {
-		return err
+// checkDialerProxies makes sure every sockopt.dialerProxy names an outbound
+// that will exist, since Xray refuses to start otherwise.
+func checkDialerProxies(outbounds []interface{}) error {
+	tags := map[string]bool{}
+	for _, o := range outbounds {
+		if ob, ok := o.(map[string]interface{}); ok {
+			if tag, _ := ob["tag"].(string); tag != "" {
+				tags[tag] = true
+			}
+		}
 	}
-	var newOutbounds []interface{}
-	if err := json.Unmarshal(generated, &newOutbounds); err != nil {
-		return err
+	for _, o := range outbounds {
+		ob, _ := o.(map[string]interface{})
+		ss, _ := ob["streamSettings"].(map[string]interface{})
+		sockopt, _ := ss["sockopt"].(map[string]interface{})
+		if p, _ := sockopt["dialerProxy"].(string); p != "" && !tags[p] {
+			return fmt.Errorf("outbound %v: dialerProxy %q does not exist", ob["tag"], p)
+		}
 	}
-	outbounds = append(outbounds, newOutbounds...)
-
-	xraySetting["outbounds"] = outbounds
-	putPanelConfig(baseURL, token, xraySetting, allowInsecure)
-	restartXrayService(baseURL, token, allowInsecure)
-	fmt.Println("[update] completed")
 	return nil
 }
@@ -0,0 +1,407 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/SamMHD/cfscanner-to-3xui/internal/xuimock"
+)
+
+func panelXraySetting() map[string]interface{} {
+	return map[string]interface{}{
+		"log": map[string]interface{}{"loglevel": "warning"},
+		"outbounds": []interface{}{
+			map[string]interface{}{"protocol": "freedom", "tag": "direct"},
+			map[string]interface{}{"protocol": "blackhole", "tag": "blocked"},
+			map[string]interface{}{"protocol": "trojan", "tag": "cf-clean-trojan-1.1.1.1"},
+		},
+	}
+}
+
+// setupUpdate starts a fake panel, points the XUI_* variables at it and
+// writes generated outbounds into a fresh working directory.
+func setupUpdate(t *testing.T, generated []interface{}) *xuimock.Server {
+	t.Helper()
+	panel := xuimock.New("admin", "secret", panelXraySetting())
+	t.Cleanup(panel.Close)
+
+	t.Chdir(t.TempDir())
+	data, err := json.Marshal(generated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(generatedOutboundsPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("XUI_URL", panel.URL)
+	t.Setenv("XUI_USERNAME", "admin")
+	t.Setenv("XUI_PASSWORD", "secret")
+	t.Setenv("XUI_RETRIES", "2")
+	t.Setenv("XUI_RETRY_DELAY", "0.001")
+	t.Setenv("OUTBOUND_PREFIX", "cf-clean-")
+	return panel
+}
+
+func outboundTags(obs []interface{}) []string {
+	var tags []string
+	for _, o := range obs {
+		m, _ := o.(map[string]interface{})
+		tag, _ := m["tag"].(string)
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func TestRunUpdateReplacesPrefixedOutbounds(t *testing.T) {
+	panel := setupUpdate(t, []interface{}{
+		map[string]interface{}{"protocol": "vless", "tag": "cf-clean-vless-2.2.2.2"},
+	})
+
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(outboundTags(panel.Outbounds()), ",")
+	if want := "direct,blocked,cf-clean-vless-2.2.2.2"; got != want {
+		t.Errorf("outbounds = %s, want %s", got, want)
+	}
+	if panel.Updates != 1 || panel.Restarts != 1 {
+		t.Errorf("updates=%d restarts=%d, want 1 and 1", panel.Updates, panel.Restarts)
+	}
+	if _, ok := panel.XraySetting["log"]; !ok {
+		t.Error("unrelated xraySetting keys were dropped")
+	}
+}
+
+func TestRunUpdateReplacesPrefixedBalancers(t *testing.T) {
+	panel := setupUpdate(t, []interface{}{
+		map[string]interface{}{"protocol": "vless", "tag": "cf-clean-vless-FRA-2.2.2.2"},
+	})
+	panel.XraySetting["routing"] = map[string]interface{}{
+		"balancers": []interface{}{
+			map[string]interface{}{"tag": "mine", "selector": []interface{}{"direct"}},
+			map[string]interface{}{"tag": "cf-clean-balancer-AMS", "selector": []interface{}{"cf-clean-vless-AMS-"}},
+		},
+	}
+	data, _ := json.Marshal([]interface{}{
+		map[string]interface{}{"tag": "cf-clean-balancer-FRA", "selector": []interface{}{"cf-clean-vless-FRA-"}},
+	})
+	if err := os.WriteFile(generatedBalancersPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	routing := panel.XraySetting["routing"].(map[string]interface{})
+	got := strings.Join(outboundTags(routing["balancers"].([]interface{})), ",")
+	if want := "mine,cf-clean-balancer-FRA"; got != want {
+		t.Errorf("balancers = %s, want %s", got, want)
+	}
+}
+
+func TestRunUpdateWebBasePathAndCookieName(t *testing.T) {
+	panel := setupUpdate(t, []interface{}{})
+	panel.BasePath = "/hidden"
+	panel.CookieName = "session"
+	t.Setenv("XUI_WEB_BASE_PATH", "/hidden/")
+
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if panel.Updates != 1 {
+		t.Errorf("updates = %d, want 1", panel.Updates)
+	}
+}
+
+func TestRunUpdateBadCredentials(t *testing.T) {
+	panel := setupUpdate(t, []interface{}{})
+	t.Setenv("XUI_PASSWORD", "wrong")
+
+	err := runUpdate(updateCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "username or password") {
+		t.Fatalf("err = %v, want rejected username or password", err)
+	}
+	if panel.Updates != 0 {
+		t.Errorf("updates = %d, want 0", panel.Updates)
+	}
+}
+
+func TestRunUpdatePanelFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*xuimock.Server)
+		wantErr string
+		updates int
+	}{
+		{"config success=false", func(p *xuimock.Server) { p.FailConfig = xuimock.SuccessFalse }, "success=false", 0},
+		{"config empty body", func(p *xuimock.Server) { p.FailConfig = xuimock.EmptyBody }, "unexpected end of JSON", 0},
+		{"config non-JSON", func(p *xuimock.Server) { p.FailConfig = xuimock.NonJSON }, "invalid character", 0},
+		{"update success=false", func(p *xuimock.Server) { p.FailUpdate = xuimock.SuccessFalse }, "panel update success=false", 0},
+		{"update empty body", func(p *xuimock.Server) { p.FailUpdate = xuimock.EmptyBody }, "", 0},
+		{"update non-JSON", func(p *xuimock.Server) { p.FailUpdate = xuimock.NonJSON }, "panel update", 0},
+		{"restart success=false", func(p *xuimock.Server) { p.FailRestart = xuimock.SuccessFalse }, "restartXrayService success=false", 1},
+		{"restart non-JSON", func(p *xuimock.Server) { p.FailRestart = xuimock.NonJSON }, "", 1},
+		{"login 502 recovers", func(p *xuimock.Server) { p.FailLogin, p.FailTimes = xuimock.BadGateway, 1 }, "", 1},
+		{"config 502 persists", func(p *xuimock.Server) { p.FailConfig = xuimock.BadGateway }, "status 502", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panel := setupUpdate(t, []interface{}{})
+			tt.setup(panel)
+
+			err := runUpdate(updateCmd, nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if panel.Updates != tt.updates {
+				t.Errorf("updates = %d, want %d", panel.Updates, tt.updates)
+			}
+		})
+	}
+}
+
+func TestRunUpdateMissingGeneratedFile(t *testing.T) {
+	panel := setupUpdate(t, nil)
+	if err := os.Remove(filepath.Join(".", generatedOutboundsPath)); err != nil {
+		t.Fatal(err)
+	}
+	if err := runUpdate(updateCmd, nil); err == nil {
+		t.Fatal("expected an error without generated outbounds")
+	}
+	if panel.Updates != 0 {
+		t.Errorf("updates = %d, want 0", panel.Updates)
+	}
+}
+
+func TestRunUpdateRejectsTruncatedGeneratedFile(t *testing.T) {
+	panel := setupUpdate(t, nil)
+	for _, data := range []string{`[{"protocol": "vless", "tag": "cf-clean-vless-2.2.2.2"`, `[{"tag": "direct"}]`} {
+		if err := os.WriteFile(generatedOutboundsPath, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := runUpdate(updateCmd, nil); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+	if panel.Logins != 0 || panel.Updates != 0 {
+		t.Errorf("logins=%d updates=%d, want the panel untouched", panel.Logins, panel.Updates)
+	}
+}
+
+func TestGenerateAndUpdateUseWorkDir(t *testing.T) {
+	panel := setupUpdate(t, nil)
+	if err := os.Remove(generatedOutboundsPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("configs", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("configs", "trojan.json"), []byte(trojanTemplate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WORK_DIR", "state")
+	t.Setenv("SCAN_O", "result.csv")
+	if err := writeScanCSV(scanOutputPath(), []ScanResult{{IP: "3.3.3.3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runGenerate(generateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join("state", generatedOutboundsPath)); err != nil {
+		t.Fatal(err)
+	}
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(outboundTags(panel.Outbounds()), ","), "direct,blocked,cf-clean-trojan-3.3.3.3"; got != want {
+		t.Errorf("outbounds = %s, want %s", got, want)
+	}
+	if left, _ := filepath.Glob(filepath.Join("state", ".*tmp-*")); len(left) > 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+}
+
+func TestRunUpdateSkipsWhenUnchanged(t *testing.T) {
+	panel := setupUpdate(t, []interface{}{
+		map[string]interface{}{"protocol": "vless", "tag": "cf-clean-vless-2.2.2.2", "settings": map[string]interface{}{"port": 443}},
+		map[string]interface{}{"protocol": "vless", "tag": "cf-clean-vless-3.3.3.3"},
+	})
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same outbounds in a different order and key order: nothing to push.
+	reordered := `[{"tag": "cf-clean-vless-3.3.3.3", "protocol": "vless"},
+		{"settings": {"port": 443}, "tag": "cf-clean-vless-2.2.2.2", "protocol": "vless"}]`
+	if err := os.WriteFile(generatedOutboundsPath, []byte(reordered), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if panel.Updates != 1 || panel.Restarts != 1 {
+		t.Errorf("updates=%d restarts=%d, want 1 and 1", panel.Updates, panel.Restarts)
+	}
+
+	// A changed outbound is pushed again.
+	changed := strings.Replace(reordered, "443", "2053", 1)
+	if err := os.WriteFile(generatedOutboundsPath, []byte(changed), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if panel.Updates != 2 || panel.Restarts != 2 {
+		t.Errorf("updates=%d restarts=%d, want 2 and 2", panel.Updates, panel.Restarts)
+	}
+}
+
+func TestRunUpdateRestartsAfterFailedApply(t *testing.T) {
+	panel := setupUpdate(t, []interface{}{
+		map[string]interface{}{"protocol": "vless", "tag": "cf-clean-vless-2.2.2.2"},
+	})
+	panel.FailRestart, panel.FailTimes = xuimock.SuccessFalse, 1
+	if err := runUpdate(updateCmd, nil); err == nil {
+		t.Fatal("update with failing restart succeeded")
+	}
+	if panel.Updates != 1 || panel.Restarts != 0 {
+		t.Fatalf("updates=%d restarts=%d, want 1 and 0", panel.Updates, panel.Restarts)
+	}
+
+	// The panel already holds the config, but Xray never got it.
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if panel.Updates != 1 || panel.Restarts != 1 {
+		t.Errorf("updates=%d restarts=%d, want 1 and 1", panel.Updates, panel.Restarts)
+	}
+	if _, err := os.Stat(applyPendingPath); !os.IsNotExist(err) {
+		t.Errorf("pending marker left after restart: %v", err)
+	}
+
+	// Once applied, the same config is a no-op again.
+	if err := runUpdate(updateCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if panel.Updates != 1 || panel.Restarts != 1 {
+		t.Errorf("updates=%d restarts=%d, want 1 and 1", panel.Updates, panel.Restarts)
+	}
+}
+
+// fakeXray writes a stand-in for the xray binary that logs its arguments
+// (and the outbounds of "api ado") and exits with status.
+func fakeXray(t *testing.T, status int) (bin, log string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake xray is a shell script")
+	}
+	dir := t.TempDir()
+	bin, log = filepath.Join(dir, "xray"), filepath.Join(dir, "calls.log")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %[1]q
+if [ "$2" = ado ]; then cat "$4" >> %[1]q; echo >> %[1]q; fi
+exit %[2]d
+`, log, status)
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return bin, log
+}
+
+func TestRunUpdateHotApply(t *testing.T) {
+	tests := []struct {
+		name         string
+		handler      bool
+		status       int
+		wantRestarts int
+		wantCalls    bool
+	}{
+		{"applied", true, 0, 0, true},
+		{"api error", true, 1, 1, true},
+		{"no HandlerService", false, 0, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panel := setupUpdate(t, []interface{}{
+				map[string]interface{}{"protocol": "vless", "tag": "cf-clean-vless-2.2.2.2"},
+			})
+			if tt.handler {
+				panel.XraySetting["api"] = map[string]interface{}{"tag": "api", "services": []interface{}{"HandlerService", "StatsService"}}
+			}
+			bin, log := fakeXray(t, tt.status)
+			t.Setenv("UPDATE_MODE", "hot")
+			t.Setenv("XRAY_BIN", bin)
+			t.Setenv("XRAY_API", "127.0.0.1:10085")
+
+			if err := runUpdate(updateCmd, nil); err != nil {
+				t.Fatal(err)
+			}
+			if panel.Updates != 1 || panel.Restarts != tt.wantRestarts {
+				t.Errorf("updates=%d restarts=%d, want 1 and %d", panel.Updates, panel.Restarts, tt.wantRestarts)
+			}
+			calls, _ := os.ReadFile(log)
+			if !tt.wantCalls {
+				if len(calls) > 0 {
+					t.Errorf("unexpected xray calls:\n%s", calls)
+				}
+				return
+			}
+			if !strings.HasPrefix(string(calls), "api rmo --server=127.0.0.1:10085 cf-clean-trojan-1.1.1.1\n") {
+				t.Errorf("calls = %q, want the old outbound removed first", calls)
+			}
+			if tt.status == 0 && !strings.Contains(string(calls), `"tag":"cf-clean-vless-2.2.2.2"`) {
+				t.Errorf("calls = %q, want the new outbound added", calls)
+			}
+		})
+	}
+}
+
+func TestRunUpdateHotWithoutXray(t *testing.T) {
+	panel := setupUpdate(t, []interface{}{
+		map[string]interface{}{"protocol": "vless", "tag": "cf-clean-vless-2.2.2.2"},
+	})
+	t.Setenv("UPDATE_MODE", "hot")
+	t.Setenv("XRAY_BIN", filepath.Join(t.TempDir(), "xray"))
+
+	err := runUpdate(updateCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "XRAY_BIN") {
+		t.Fatalf("err = %v, want a missing xray binary", err)
+	}
+	if panel.Logins != 0 || panel.Updates != 0 || panel.Restarts != 0 {
+		t.Errorf("panel touched: logins=%d updates=%d restarts=%d", panel.Logins, panel.Updates, panel.Restarts)
+	}
+}
+
+func TestDiffOutbounds(t *testing.T) {
+	before := []interface{}{
+		map[string]interface{}{"tag": "direct"},
+		map[string]interface{}{"tag": "cf-a", "port": 1.0},
+		map[string]interface{}{"tag": "cf-b"},
+		map[string]interface{}{"tag": "cf-c"},
+	}
+	after := []interface{}{
+		map[string]interface{}{"tag": "direct", "changed": true},
+		map[string]interface{}{"tag": "cf-a", "port": 2.0},
+		map[string]interface{}{"tag": "cf-b"},
+		map[string]interface{}{"tag": "cf-d"},
+	}
+	remove, add := diffOutbounds(before, after, "cf-")
+	if got := strings.Join(remove, ","); got != "cf-a,cf-c" {
+		t.Errorf("remove = %s, want cf-a,cf-c", got)
+	}
+	if got := strings.Join(outboundTags(add), ","); got != "cf-a,cf-d" {
+		t.Errorf("add = %s, want cf-a,cf-d", got)
+	}
+}
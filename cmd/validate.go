@@ -0,0 +1,426 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the templates in configs/ against the Xray outbound schema",
+	Long: `Check every JSON template in configs/ against the Xray outbound schema
+of the supported protocols (trojan, vless) and report each problem with
+its file and JSON path. generate and run perform the same checks first.`,
+	RunE: runValidate,
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	errs, err := validateConfigs(configsDir())
+	if err != nil {
+		return err
+	}
+	log := stageLog("validate")
+	for _, e := range errs {
+		log.Error("template problem", "file", e.File, "path", e.Path, "problem", e.Msg)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d template problem(s) in %s", len(errs), configsDir())
+	}
+	log.Info("templates OK", "dir", configsDir())
+	return nil
+}
+
+// templateError is one schema violation at a JSON path of a template file.
+type templateError struct {
+	File string
+	Path string
+	Msg  string
+}
+
+func (e templateError) Error() string {
+	if e.Path == "" {
+		return e.File + ": " + e.Msg
+	}
+	return e.File + ": " + e.Path + ": " + e.Msg
+}
+
+// validateConfigs checks every template file in dir. Problems with the
+// templates are returned as the slice; err is for an unreadable dir.
+func validateConfigs(dir string) ([]templateError, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var errs []templateError
+	n, disabled := 0, 0
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		n++
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			errs = append(errs, templateError{File: e.Name(), Msg: err.Error()})
+			continue
+		}
+		errs = append(errs, validateTemplate(e.Name(), v)...)
+		m, _ := v.(map[string]interface{})
+		meta, _ := m["meta"].(map[string]interface{})
+		if meta["enabled"] == false {
+			disabled++
+		}
+	}
+	switch {
+	case n == 0:
+		errs = append(errs, templateError{File: dir, Msg: "no .json templates"})
+	case disabled == n:
+		errs = append(errs, templateError{File: dir, Msg: "every template is disabled"})
+	}
+	return errs, nil
+}
+
+// templateErrors joins validation problems into one error, or nil.
+func templateErrors(errs []templateError) error {
+	all := make([]error, len(errs))
+	for i, e := range errs {
+		all[i] = e
+	}
+	return errors.Join(all...)
+}
+
+// outboundFields are the top-level keys of an Xray outbound, plus our own.
+var outboundFields = []string{
+	"protocol", "tag", "settings", "streamSettings", "proxySettings", "mux",
+	"sendThrough", "targetStrategy", "matrix", "meta",
+}
+
+var metaFields = []string{"id", "name", "enabled", "maxIPs", "ipFamily", "colos", "tag"}
+
+var (
+	streamNetworks  = []string{"tcp", "raw", "ws", "grpc", "httpupgrade", "xhttp", "splithttp", "kcp", "quic", "http", "h2"}
+	streamSecurity  = []string{"", "none", "tls", "reality"}
+	vlessEncryption = []string{"none"}
+)
+
+// schemaCheck collects the problems found in one template.
+type schemaCheck struct {
+	file string
+	errs []templateError
+}
+
+func (c *schemaCheck) fail(path, format string, args ...interface{}) {
+	c.errs = append(c.errs, templateError{File: c.file, Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func jsonPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// object returns v as an object, reporting a type error otherwise.
+func (c *schemaCheck) object(path string, v interface{}) map[string]interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		c.fail(path, "must be an object, got %s", jsonType(v))
+	}
+	return m
+}
+
+// list returns m[key] as a non-empty array when required, or nil when an
+// optional key is absent.
+func (c *schemaCheck) list(m map[string]interface{}, path, key string, required bool) []interface{} {
+	v, ok := m[key]
+	if !ok {
+		if required {
+			c.fail(jsonPath(path, key), "required")
+		}
+		return nil
+	}
+	a, ok := v.([]interface{})
+	if !ok {
+		c.fail(jsonPath(path, key), "must be an array, got %s", jsonType(v))
+		return nil
+	}
+	if required && len(a) == 0 {
+		c.fail(jsonPath(path, key), "must not be empty")
+	}
+	return a
+}
+
+// str checks that m[key] is a string (non-empty when required) and, if
+// allowed is given, one of allowed.
+func (c *schemaCheck) str(m map[string]interface{}, path, key string, required bool, allowed ...string) {
+	v, ok := m[key]
+	if !ok {
+		if required {
+			c.fail(jsonPath(path, key), "required")
+		}
+		return
+	}
+	s, ok := v.(string)
+	switch {
+	case !ok:
+		c.fail(jsonPath(path, key), "must be a string, got %s", jsonType(v))
+	case required && s == "":
+		c.fail(jsonPath(path, key), "must not be empty")
+	case len(allowed) > 0 && !slices.Contains(allowed, s):
+		want := slices.DeleteFunc(slices.Clone(allowed), func(a string) bool { return a == "" })
+		c.fail(jsonPath(path, key), "unsupported value %q (want one of %s)", s, strings.Join(want, ", "))
+	}
+}
+
+func (c *schemaCheck) boolean(m map[string]interface{}, path, key string) {
+	if v, ok := m[key]; ok {
+		if _, ok := v.(bool); !ok {
+			c.fail(jsonPath(path, key), "must be a boolean, got %s", jsonType(v))
+		}
+	}
+}
+
+func (c *schemaCheck) port(path string, v interface{}) {
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || f < 1 || f > 65535 {
+		c.fail(path, "must be a port number (1-65535), got %s", jsonValue(v))
+	}
+}
+
+func (c *schemaCheck) strList(m map[string]interface{}, path, key string) {
+	for i, v := range c.list(m, path, key, false) {
+		if _, ok := v.(string); !ok {
+			c.fail(fmt.Sprintf("%s[%d]", jsonPath(path, key), i), "must be a string, got %s", jsonType(v))
+		}
+	}
+}
+
+// validateTemplate checks one parsed template file.
+func validateTemplate(file string, v interface{}) []templateError {
+	c := &schemaCheck{file: file}
+	ob := c.object("", v)
+	if ob == nil {
+		return c.errs
+	}
+	var unknown []string
+	for k := range ob {
+		if !slices.Contains(outboundFields, k) {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		c.fail(k, "unknown outbound field")
+	}
+
+	c.str(ob, "", "protocol", true, "trojan", "vless")
+	c.str(ob, "", "tag", false)
+	if s, ok := ob["settings"]; !ok {
+		c.fail("settings", "required")
+	} else if settings := c.object("settings", s); settings != nil {
+		switch ob["protocol"] {
+		case "trojan":
+			c.trojanSettings(settings)
+		case "vless":
+			c.vlessSettings(settings)
+		}
+	}
+	if s, ok := ob["streamSettings"]; ok {
+		if ss := c.object("streamSettings", s); ss != nil {
+			c.streamSettings(ss)
+		}
+	}
+	if m, ok := ob["mux"]; ok {
+		if mux := c.object("mux", m); mux != nil {
+			c.boolean(mux, "mux", "enabled")
+		}
+	}
+	if m, ok := ob["meta"]; ok {
+		if meta := c.object("meta", m); meta != nil {
+			c.meta(meta)
+		}
+	}
+	if m, ok := ob["matrix"]; ok {
+		if matrix := c.object("matrix", m); matrix != nil {
+			for i, p := range c.list(matrix, "matrix", "ports", false) {
+				c.port(fmt.Sprintf("matrix.ports[%d]", i), p)
+			}
+			c.strList(matrix, "matrix", "sni")
+			if sni, _ := matrix["sni"].([]interface{}); len(sni) > 0 {
+				ss, _ := ob["streamSettings"].(map[string]interface{})
+				if security, _ := ss["security"].(string); security != "tls" && security != "reality" {
+					c.fail("matrix.sni", "needs streamSettings.security tls or reality, got %q", security)
+				}
+			}
+		}
+	}
+	return c.errs
+}
+
+func (c *schemaCheck) meta(meta map[string]interface{}) {
+	var unknown []string
+	for k := range meta {
+		if !slices.Contains(metaFields, k) {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		c.fail("meta."+k, "unknown meta field")
+	}
+	c.str(meta, "meta", "id", false)
+	if id, ok := meta["id"].(string); ok && id != "" && tagSlug(id) == "" {
+		c.fail("meta.id", "must contain a letter or digit")
+	}
+	c.str(meta, "meta", "name", false)
+	c.boolean(meta, "meta", "enabled")
+	if v, ok := meta["maxIPs"]; ok {
+		if f, ok := v.(float64); !ok || f != math.Trunc(f) || f < 0 {
+			c.fail("meta.maxIPs", "must be a non-negative integer, got %s", jsonValue(v))
+		}
+	}
+	c.str(meta, "meta", "ipFamily", false, "v4", "v6", "mixed")
+	c.strList(meta, "meta", "colos")
+	c.str(meta, "meta", "tag", false)
+	if tag, ok := meta["tag"].(string); ok {
+		// update owns outbounds by prefix, and one tag per IP is needed.
+		if !strings.HasPrefix(tag, "{prefix}") {
+			c.fail("meta.tag", "must start with {prefix}")
+		}
+		if !strings.Contains(tag, "{ip}") {
+			c.fail("meta.tag", "must contain {ip}")
+		}
+	}
+}
+
+func (c *schemaCheck) trojanSettings(settings map[string]interface{}) {
+	for i, s := range c.list(settings, "settings", "servers", true) {
+		path := fmt.Sprintf("settings.servers[%d]", i)
+		server := c.object(path, s)
+		if server == nil {
+			continue
+		}
+		c.str(server, path, "address", false)
+		if p, ok := server["port"]; ok {
+			c.port(path+".port", p)
+		} else {
+			c.fail(path+".port", "required")
+		}
+		c.str(server, path, "password", true)
+		c.str(server, path, "email", false)
+		c.str(server, path, "flow", false)
+	}
+}
+
+func (c *schemaCheck) vlessSettings(settings map[string]interface{}) {
+	for i, s := range c.list(settings, "settings", "vnext", true) {
+		path := fmt.Sprintf("settings.vnext[%d]", i)
+		server := c.object(path, s)
+		if server == nil {
+			continue
+		}
+		c.str(server, path, "address", false)
+		if p, ok := server["port"]; ok {
+			c.port(path+".port", p)
+		} else {
+			c.fail(path+".port", "required")
+		}
+		for j, u := range c.list(server, path, "users", true) {
+			upath := fmt.Sprintf("%s.users[%d]", path, j)
+			user := c.object(upath, u)
+			if user == nil {
+				continue
+			}
+			c.str(user, upath, "id", true)
+			c.str(user, upath, "encryption", false, vlessEncryption...)
+			c.str(user, upath, "flow", false)
+		}
+	}
+}
+
+func (c *schemaCheck) streamSettings(ss map[string]interface{}) {
+	c.str(ss, "streamSettings", "network", false, streamNetworks...)
+	c.str(ss, "streamSettings", "security", false, streamSecurity...)
+	if t, ok := ss["tlsSettings"]; ok {
+		if tls := c.object("streamSettings.tlsSettings", t); tls != nil {
+			c.str(tls, "streamSettings.tlsSettings", "serverName", false)
+			c.str(tls, "streamSettings.tlsSettings", "fingerprint", false)
+			c.strList(tls, "streamSettings.tlsSettings", "alpn")
+			c.boolean(tls, "streamSettings.tlsSettings", "allowInsecure")
+		}
+	}
+	if w, ok := ss["wsSettings"]; ok {
+		if ws := c.object("streamSettings.wsSettings", w); ws != nil {
+			c.str(ws, "streamSettings.wsSettings", "path", false)
+			c.str(ws, "streamSettings.wsSettings", "host", false)
+			if h, ok := ws["headers"]; ok {
+				if headers := c.object("streamSettings.wsSettings.headers", h); headers != nil {
+					for k := range headers {
+						c.str(headers, "streamSettings.wsSettings.headers", k, false)
+					}
+				}
+			}
+		}
+	}
+	for _, key := range []string{"httpupgradeSettings", "xhttpSettings", "splithttpSettings"} {
+		if t, ok := ss[key]; ok {
+			if m := c.object("streamSettings."+key, t); m != nil {
+				c.str(m, "streamSettings."+key, "path", false)
+				c.str(m, "streamSettings."+key, "host", false)
+			}
+		}
+	}
+	if g, ok := ss["grpcSettings"]; ok {
+		if grpc := c.object("streamSettings.grpcSettings", g); grpc != nil {
+			c.str(grpc, "streamSettings.grpcSettings", "serviceName", false)
+			c.str(grpc, "streamSettings.grpcSettings", "authority", false)
+			c.boolean(grpc, "streamSettings.grpcSettings", "multiMode")
+		}
+	}
+	if s, ok := ss["sockopt"]; ok {
+		if sockopt := c.object("streamSettings.sockopt", s); sockopt != nil {
+			c.str(sockopt, "streamSettings.sockopt", "dialerProxy", false)
+		}
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func jsonValue(v interface{}) string {
+	if v == nil {
+		return "null"
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		name, template string
+		want           []string
+	}{
+		{"valid trojan", trojanTemplate, nil},
+		{"valid vless", `{"protocol": "vless", "settings": {"vnext": [{"address": "x", "port": 443, "users": [{"id": "u", "encryption": "none"}]}]},
+			"streamSettings": {"network": "ws", "security": "tls", "wsSettings": {"headers": {"Host": "h"}}}}`, nil},
+		{"protocol typo", `{"protocol": "trojen", "settings": {}}`,
+			[]string{`protocol: unsupported value "trojen" (want one of trojan, vless)`}},
+		{"missing servers", `{"protocol": "trojan", "settings": {}}`,
+			[]string{"settings.servers: required"}},
+		{"wrong types", `{"protocol": "trojan", "settings": {"servers": [{"port": "443", "password": 1}]}, "streamSetting": {}}`,
+			[]string{"streamSetting: unknown outbound field", `settings.servers[0].port: must be a port number (1-65535), got "443"`, "settings.servers[0].password: must be a string, got number"}},
+		{"vless users", `{"protocol": "vless", "settings": {"vnext": [{"port": 443, "users": [{"id": ""}]}]}, "streamSettings": {"network": "websocket"}}`,
+			[]string{"settings.vnext[0].users[0].id: must not be empty", `streamSettings.network: unsupported value "websocket"`}},
+		{"meta", `{"protocol": "trojan", "settings": {"servers": [{"port": 443, "password": "p"}]}, "meta": {"enabled": "no", "ipFamily": "v5", "maxIPs": -1, "tag": "x-{colo}", "colour": 1}}`,
+			[]string{"meta.colour: unknown meta field", "meta.enabled: must be a boolean", "meta.maxIPs: must be a non-negative integer", `meta.ipFamily: unsupported value "v5"`, "meta.tag: must start with {prefix}", "meta.tag: must contain {ip}"}},
+		{"matrix", `{"protocol": "trojan", "settings": {"servers": [{"port": 443, "password": "p"}]}, "streamSettings": {"security": "tls"}, "matrix": {"ports": [443, 70000], "sni": [1]}}`,
+			[]string{"matrix.ports[1]: must be a port number", "matrix.sni[0]: must be a string"}},
+		{"sni without tls", `{"protocol": "trojan", "settings": {"servers": [{"port": 443, "password": "p"}]}, "streamSettings": {"security": "none"}, "matrix": {"sni": ["a.example.com"]}}`,
+			[]string{`matrix.sni: needs streamSettings.security tls or reality, got "none"`}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "t.json"), []byte(tt.template), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		errs, err := validateConfigs(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(errs) != len(tt.want) {
+			t.Errorf("%s: got %v, want %d problems", tt.name, errs, len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			if got := errs[i].Error(); !strings.HasPrefix(got, "t.json: "+want) {
+				t.Errorf("%s: problem %d = %q, want %q", tt.name, i, got, want)
+			}
+		}
+		if _, err := readConfigs(dir); (err != nil) != (len(tt.want) > 0) {
+			t.Errorf("%s: readConfigs error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestValidateAndReadConfigsNeedAnEnabledTemplate(t *testing.T) {
+	disabled := strings.Replace(trojanTemplate, `"protocol"`, `"meta": {"enabled": false}, "protocol"`, 1)
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"empty", nil, "no .json templates"},
+		{"not json", map[string]string{"readme.txt": "x"}, "no .json templates"},
+		{"all disabled", map[string]string{"a.json": disabled, "b.json": disabled}, "every template is disabled"},
+	} {
+		dir := t.TempDir()
+		for name, data := range tt.files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		errs, err := validateConfigs(dir)
+		if err != nil || len(errs) != 1 || errs[0].Msg != tt.want {
+			t.Errorf("%s: validate = %v, %v; want %q", tt.name, errs, err, tt.want)
+		}
+		if _, err := readConfigs(dir); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: readConfigs error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
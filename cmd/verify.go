@@ -0,0 +1,414 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Drop scanned IPs that cannot complete a real TLS + transport handshake to the origin",
+	Long: `For every IP in the scan result and every template in configs/, build the
+outbound generate would build and complete its handshake through that IP:
+TLS with the template's SNI, then a WebSocket / HTTPUpgrade upgrade, a gRPC
+call or an XHTTP request with its host and path. Failures are recorded per
+template in the "Failed Templates" column and generate skips those
+outbounds; IPs that fail every template are removed from the scan result.
+The rest get their average handshake latency recorded in the
+"Handshake (ms)" column.`,
+	RunE: runVerify,
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// verifyEnabled reports whether run includes the verify stage (VERIFY).
+func verifyEnabled() bool {
+	return envBool("VERIFY", false)
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+	output := scanOutputPath()
+	data, err := os.ReadFile(output)
+	if err != nil {
+		return err
+	}
+	results, err := parseScanCSV(data)
+	if err != nil {
+		return err
+	}
+	configs, err := readConfigs(configsDir())
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(envFloat("VERIFY_TIMEOUT", 5) * float64(time.Second))
+	threads := max(envInt("VERIFY_THREADS", 20), 1)
+
+	var (
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, threads)
+		passed = make([][]string, len(results)) // variants each IP passed
+	)
+	for i := range results {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *ScanResult, pass *[]string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var total time.Duration
+			r.FailedTemplates = nil
+			addr, _ := netip.ParseAddr(r.IP)
+			for _, t := range configs {
+				// Templates that would never be generated for this IP
+				// (family or colo filter) do not need to pass.
+				if !t.Meta.accepts(addr, strings.ToUpper(r.Colo)) {
+					continue
+				}
+				ob, err := cloneAndSetAddress(t, r.IP, "")
+				if err == nil {
+					var d time.Duration
+					if d, err = handshakeOutbound(ob, timeout); err == nil {
+						total += d
+						*pass = append(*pass, t.variant())
+						continue
+					}
+				}
+				stageLog("verify").Info("handshake failed", "ip", r.IP, "template", t.variant(), "err", err)
+				r.FailedTemplates = append(r.FailedTemplates, t.variant())
+			}
+			if n := len(*pass); n > 0 {
+				r.Handshake = total / time.Duration(n)
+			}
+		}(&results[i], &passed[i])
+	}
+	wg.Wait()
+
+	// An IP is dropped for the templates it failed; only an IP that failed
+	// every template it was tried with is dropped from the scan result.
+	var (
+		kept   []ScanResult
+		failed []string
+		tried  = map[string]int{}
+		ok     = map[string]int{}
+		order  []string
+	)
+	for i, r := range results {
+		for _, v := range passed[i] {
+			ok[v]++
+		}
+		for _, v := range append(passed[i], r.FailedTemplates...) {
+			if tried[v] == 0 {
+				order = append(order, v)
+			}
+			tried[v]++
+		}
+		if len(passed[i]) > 0 || len(r.FailedTemplates) == 0 {
+			kept = append(kept, r)
+		} else {
+			failed = append(failed, r.IP)
+		}
+	}
+	sort.Strings(order)
+	var summary []string
+	for _, v := range order {
+		summary = append(summary, fmt.Sprintf("%s: %d/%d", v, ok[v], tried[v]))
+		if ok[v] == 0 {
+			stageLog("verify").Warn("template passed through no IP; it gets no outbounds", "template", v, "ips", tried[v])
+		}
+	}
+	stageLog("verify").Info("verified", "passed", len(kept), "ips", len(results))
+	noteIPs(len(kept))
+	if err := amendScanHistory(kept, failed); err != nil {
+		return err
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("no scanned IP completed the handshake for any template (%s); keeping %s unchanged", strings.Join(summary, ", "), output)
+	}
+	return writeScanCSV(output, kept)
+}
+
+// outboundStream is the part of an outbound's streamSettings the handshake needs.
+type outboundStream struct {
+	Network     string `json:"network"`
+	Security    string `json:"security"`
+	TLSSettings struct {
+		ServerName    string   `json:"serverName"`
+		ALPN          []string `json:"alpn"`
+		AllowInsecure bool     `json:"allowInsecure"`
+	} `json:"tlsSettings"`
+	WSSettings struct {
+		Path    string            `json:"path"`
+		Host    string            `json:"host"`
+		Headers map[string]string `json:"headers"`
+	} `json:"wsSettings"`
+	HTTPUpgradeSettings struct {
+		Path string `json:"path"`
+		Host string `json:"host"`
+	} `json:"httpupgradeSettings"`
+	GRPCSettings struct {
+		ServiceName string `json:"serviceName"`
+		Authority   string `json:"authority"`
+	} `json:"grpcSettings"`
+	XHTTPSettings struct {
+		Path string `json:"path"`
+		Host string `json:"host"`
+	} `json:"xhttpSettings"`
+	SplitHTTPSettings struct {
+		Path string `json:"path"`
+		Host string `json:"host"`
+	} `json:"splithttpSettings"`
+}
+
+// outboundServer returns the address and port a trojan or vless outbound dials.
+func outboundServer(ob map[string]interface{}) (string, int) {
+	settings, _ := ob["settings"].(map[string]interface{})
+	var servers []interface{}
+	switch ob["protocol"] {
+	case "trojan":
+		servers, _ = settings["servers"].([]interface{})
+	case "vless":
+		servers, _ = settings["vnext"].([]interface{})
+	}
+	if len(servers) == 0 {
+		return "", 0
+	}
+	s, _ := servers[0].(map[string]interface{})
+	addr, _ := s["address"].(string)
+	port, _ := s["port"].(float64)
+	if port == 0 {
+		port = 443
+	}
+	return addr, int(port)
+}
+
+// handshakeOutbound connects to the outbound's server the way Xray would
+// and returns how long the handshake took.
+func handshakeOutbound(ob map[string]interface{}, timeout time.Duration) (time.Duration, error) {
+	addr, port := outboundServer(ob)
+	if addr == "" {
+		return 0, fmt.Errorf("no server address in outbound")
+	}
+	raw, err := json.Marshal(ob["streamSettings"])
+	if err != nil {
+		return 0, err
+	}
+	var ss outboundStream
+	if err := json.Unmarshal(raw, &ss); err != nil {
+		return 0, fmt.Errorf("streamSettings: %w", err)
+	}
+	target := net.JoinHostPort(addr, fmt.Sprint(port))
+
+	start := time.Now()
+	switch ss.Network {
+	case "ws":
+		host := firstNonEmpty(ss.WSSettings.Host, ss.WSSettings.Headers["Host"], ss.TLSSettings.ServerName)
+		err = upgradeHandshake(target, &ss, host, ss.WSSettings.Path, timeout)
+	case "httpupgrade":
+		host := firstNonEmpty(ss.HTTPUpgradeSettings.Host, ss.TLSSettings.ServerName)
+		err = upgradeHandshake(target, &ss, host, ss.HTTPUpgradeSettings.Path, timeout)
+	case "grpc":
+		err = grpcHandshake(target, &ss, timeout)
+	case "xhttp", "splithttp":
+		path, host := ss.XHTTPSettings.Path, ss.XHTTPSettings.Host
+		if ss.Network == "splithttp" {
+			path, host = ss.SplitHTTPSettings.Path, ss.SplitHTTPSettings.Host
+		}
+		err = xhttpHandshake(target, &ss, firstNonEmpty(host, ss.TLSSettings.ServerName), path, timeout)
+	default:
+		var conn net.Conn
+		conn, err = dialOutbound(target, &ss, ss.TLSSettings.ServerName, []string{"http/1.1"}, timeout)
+		if err == nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// dialOutbound opens a TCP connection to target and, when the stream uses
+// TLS, completes the TLS handshake with the given SNI and ALPN.
+func dialOutbound(target string, ss *outboundStream, sni string, alpn []string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if ss.Security != "tls" {
+		return conn, nil
+	}
+	if len(ss.TLSSettings.ALPN) > 0 && alpn == nil {
+		alpn = ss.TLSSettings.ALPN
+	}
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         sni,
+		NextProtos:         alpn,
+		InsecureSkipVerify: ss.TLSSettings.AllowInsecure,
+	})
+	_ = tc.SetDeadline(time.Now().Add(timeout))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return tc, nil
+}
+
+// upgradeHandshake performs the WebSocket / HTTPUpgrade request and expects
+// 101 Switching Protocols, which the edge only returns once the origin did.
+func upgradeHandshake(target string, ss *outboundStream, host, path string, timeout time.Duration) error {
+	conn, err := dialOutbound(target, ss, firstNonEmpty(ss.TLSSettings.ServerName, host), []string{"http/1.1"}, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if path == "" {
+		path = "/"
+	}
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("upgrade answered %s", resp.Status)
+	}
+	return nil
+}
+
+// grpcHandshake opens the Tun stream over HTTP/2 and expects gRPC response
+// headers from the origin.
+func grpcHandshake(target string, ss *outboundStream, timeout time.Duration) error {
+	authority := firstNonEmpty(ss.GRPCSettings.Authority, ss.TLSSettings.ServerName)
+	path := "/" + ss.GRPCSettings.ServiceName + "/Tun"
+	if strings.HasPrefix(ss.GRPCSettings.ServiceName, "/") {
+		path, _, _ = strings.Cut(ss.GRPCSettings.ServiceName, "|")
+	}
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialOutbound(target, ss, ss.TLSSettings.ServerName, []string{"h2"}, timeout)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	body, w := io.Pipe()
+	defer w.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+authority+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc") {
+		return fmt.Errorf("grpc answered %s (%s)", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	return nil
+}
+
+// xhttpHandshake sends the GET that opens an XHTTP download stream. Xray
+// answers it with 200, or with 400 when its mode needs a session id; both
+// must carry the CORS and X-Padding headers Xray sets on every XHTTP
+// response. Anything else, such as a 403 or 421 error page of the
+// Cloudflare edge or a default page answering 200, means the origin was
+// not reached.
+func xhttpHandshake(target string, ss *outboundStream, host, path string, timeout time.Duration) error {
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialOutbound(target, ss, firstNonEmpty(ss.TLSSettings.ServerName, host), nil, timeout)
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", target, timeout)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	scheme := "http"
+	if ss.Security == "tls" {
+		scheme = "https"
+	}
+	if path == "" {
+		path = "/"
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	resp, err := client.Get(scheme + "://" + host + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusBadRequest) && xrayXHTTPResponse(resp.Header) {
+		return nil
+	}
+	// The body of an Xray 200 is the download stream; other pages are short.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 8<<10))
+	if cloudflareErrorPage(resp.Header, body) {
+		return fmt.Errorf("xhttp answered %s from the Cloudflare edge, not the origin", resp.Status)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("xhttp answered %s without the Xray XHTTP headers; not an Xray origin", resp.Status)
+	}
+	return fmt.Errorf("xhttp answered %s", resp.Status)
+}
+
+// xrayXHTTPResponse reports whether headers come from an Xray XHTTP server.
+func xrayXHTTPResponse(h http.Header) bool {
+	return h.Get("X-Padding") != "" || h.Get("Access-Control-Allow-Methods") == "GET, POST"
+}
+
+// cloudflareErrorPage reports whether a response is an error page the
+// Cloudflare edge generated itself.
+func cloudflareErrorPage(h http.Header, body []byte) bool {
+	if bytes.Contains(body, []byte("cf-error-details")) || bytes.Contains(body, []byte("cf-wrapper")) {
+		return true
+	}
+	return strings.EqualFold(h.Get("Server"), "cloudflare") && !xrayXHTTPResponse(h)
+}
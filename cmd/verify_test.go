@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestVerifyDropsFailingIPs runs verify against a local TLS origin that
+// accepts WebSocket upgrades on /ws only.
+func TestVerifyDropsFailingIPs(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" || r.Host != "origin.example.com" || r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+
+	t.Chdir(t.TempDir())
+	t.Setenv("SCAN_O", "ip-scan-result.csv")
+	if err := writeScanCSV(scanOutputPath(), []ScanResult{{IP: "127.0.0.1"}, {IP: "127.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("configs", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	template := fmt.Sprintf(`{
+  "protocol": "vless",
+  "settings": {"vnext": [{"address": "0.0.0.0", "port": %s, "users": [{"id": "x"}]}]},
+  "streamSettings": {
+    "network": "ws", "security": "tls",
+    "tlsSettings": {"serverName": "origin.example.com", "allowInsecure": true},
+    "wsSettings": {"path": "/ws", "host": "origin.example.com"}
+  }
+}`, u.Port())
+	if err := os.WriteFile("configs/vless.json", []byte(template), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A broken template only costs the IPs its own outbounds.
+	bad := strings.Replace(template, `"/ws"`, `"/nope"`, 1)
+	if err := os.WriteFile("configs/broken.json", []byte(bad), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VERIFY_TIMEOUT", "2")
+
+	if err := runVerify(verifyCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(scanOutputPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ := parseScanCSV(data)
+	if len(results) != 1 || results[0].IP != "127.0.0.1" || results[0].Handshake <= 0 {
+		t.Fatalf("results = %+v, want only 127.0.0.1 with a handshake time", results)
+	}
+	if got := results[0].FailedTemplates; len(got) != 1 || got[0] != "broken.json" {
+		t.Errorf("failed templates = %v, want [broken.json]", got)
+	}
+	_, _, failed, err := readIPsFromCSV(scanOutputPath())
+	if err != nil || !failed["127.0.0.1"]["broken.json"] || failed["127.0.0.1"]["vless.json"] {
+		t.Errorf("generate sees failures %v (err %v)", failed, err)
+	}
+
+	// When every template fails every IP, the error says so per template
+	// and the CSV is left alone.
+	if err := os.WriteFile("configs/vless.json", []byte(bad), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = runVerify(verifyCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "broken.json: 0/1, vless.json: 0/1") {
+		t.Fatalf("err = %v, want per-template counts", err)
+	}
+}
+
+// TestXHTTPHandshakeRejectsEdgeErrors checks that only answers from an
+// Xray XHTTP server count, not error pages of the Cloudflare edge.
+func TestXHTTPHandshakeRejectsEdgeErrors(t *testing.T) {
+	const cfPage = `<html><body><div id="cf-wrapper"><div id="cf-error-details">Error 1016</div></div></body></html>`
+	for _, tc := range []struct {
+		name   string
+		status int
+		header map[string]string
+		body   string
+		ok     bool
+	}{
+		{"xray stream", http.StatusOK, map[string]string{"X-Padding": "XXXX"}, "", true},
+		{"xray needs session", http.StatusBadRequest, map[string]string{"X-Padding": "XXXX", "Server": "cloudflare"}, "", true},
+		{"edge 400", http.StatusBadRequest, map[string]string{"Server": "cloudflare"}, "", false},
+		{"edge 403", http.StatusForbidden, map[string]string{"Server": "cloudflare"}, cfPage, false},
+		{"edge 404", http.StatusNotFound, map[string]string{"Server": "cloudflare"}, cfPage, false},
+		{"edge 421", http.StatusMisdirectedRequest, map[string]string{"Server": "cloudflare"}, "", false},
+		{"origin 404", http.StatusNotFound, nil, "404 page not found", false},
+		{"default page 200", http.StatusOK, map[string]string{"Content-Type": "text/html"}, "<html><body>It works!</body></html>", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tc.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+			port := srv.Listener.Addr().(*net.TCPAddr).Port
+			ob := map[string]interface{}{
+				"protocol": "vless",
+				"settings": map[string]interface{}{"vnext": []interface{}{map[string]interface{}{"address": "127.0.0.1", "port": float64(port)}}},
+				"streamSettings": map[string]interface{}{
+					"network": "xhttp", "security": "tls",
+					"tlsSettings":   map[string]interface{}{"serverName": "origin.example.com", "allowInsecure": true},
+					"xhttpSettings": map[string]interface{}{"path": "/xh"},
+				},
+			}
+			_, err := handshakeOutbound(ob, 2*time.Second)
+			if tc.ok && err != nil {
+				t.Errorf("handshake failed: %v", err)
+			}
+			if !tc.ok && (err == nil || !strings.Contains(err.Error(), "xhttp answered")) {
+				t.Errorf("err = %v, want a rejected answer", err)
+			}
+		})
+	}
+}
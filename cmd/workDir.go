@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Artifacts and state (the scan CSV, generated files, history database and
+// range cache) live in WORK_DIR, default the current directory. Paths given
+// as absolute in their own variables are used as is. Templates are inputs
+// and are read from CONFIGS_DIR instead.
+
+// workPath resolves an artifact path against WORK_DIR.
+func workPath(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(envStr("WORK_DIR", "."), name)
+}
+
+// scanOutputPath is the scan CSV, SCAN_O (default ip-scan-result.csv). It
+// is resolved when a stage starts, so WORK_DIR and SCAN_O may change
+// between runs of one process.
+func scanOutputPath() string {
+	return workPath(envStr("SCAN_O", "ip-scan-result.csv"))
+}
+
+// configsDir is the template directory, CONFIGS_DIR (default configs).
+func configsDir() string {
+	return envStr("CONFIGS_DIR", "configs")
+}
+
+// ensureDir creates the parent directory of an artifact path.
+func ensureDir(path string) error {
+	return os.MkdirAll(filepath.Dir(path), 0o755)
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// With UPDATE_MODE=hot, update still saves the panel's xraySetting but
+// applies the outbound changes to the running Xray through its API
+// (HandlerService), using the xray binary's "api rmo" / "api ado"
+// subcommands, instead of restarting it: the binary turns the JSON outbounds
+// into the protobuf configs HandlerService takes. Anything that cannot be
+// applied that way falls back to a restart.
+
+// hotUpdate reports whether UPDATE_MODE selects hot-applying.
+func hotUpdate() bool {
+	return strings.EqualFold(envStr("UPDATE_MODE", "restart"), "hot")
+}
+
+// xrayAPI runs "xray api" commands against a running Xray's API inbound.
+type xrayAPI struct {
+	Bin     string
+	Server  string
+	Timeout time.Duration
+}
+
+func xrayAPIFromEnv() xrayAPI {
+	return xrayAPI{
+		Bin:     envStr("XRAY_BIN", "xray"),
+		Server:  envStr("XRAY_API", "127.0.0.1:62789"),
+		Timeout: time.Duration(envInt("XRAY_API_TIMEOUT", 10)) * time.Second,
+	}
+}
+
+// check makes sure the xray binary can be run, so a missing one fails
+// UPDATE_MODE=hot up front instead of falling back to a restart every time.
+func (a xrayAPI) check() error {
+	if _, err := exec.LookPath(a.Bin); err != nil {
+		return fmt.Errorf("UPDATE_MODE=hot needs the xray binary (XRAY_BIN=%s): %w", a.Bin, err)
+	}
+	return nil
+}
+
+func (a xrayAPI) run(args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+	defer cancel()
+	args = append([]string{"api", args[0], "--server=" + a.Server}, args[1:]...)
+	out, err := exec.CommandContext(ctx, a.Bin, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", a.Bin, strings.Join(args[:2], " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (a xrayAPI) removeOutbounds(tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	return a.run(append([]string{"rmo"}, tags...)...)
+}
+
+func (a xrayAPI) addOutbounds(outbounds []interface{}) error {
+	if len(outbounds) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(map[string]interface{}{"outbounds": outbounds})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "cfscanner-outbounds-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return a.run("ado", f.Name())
+}
+
+// handlerServiceEnabled reports whether the xraySetting exposes the API
+// with HandlerService, which add/remove outbound needs.
+func handlerServiceEnabled(xraySetting map[string]interface{}) bool {
+	api, _ := xraySetting["api"].(map[string]interface{})
+	services, _ := api["services"].([]interface{})
+	return slices.Contains(services, interface{}("HandlerService"))
+}
+
+// diffOutbounds compares the prefixed outbounds before and after an update.
+// Changed outbounds are both removed and added again.
+func diffOutbounds(before, after []interface{}, prefix string) (remove []string, add []interface{}) {
+	old := map[string]string{}
+	for _, o := range before {
+		if tag, ok := prefixedTag(o, prefix); ok {
+			data, _ := json.Marshal(o)
+			old[tag] = string(data)
+		}
+	}
+	kept := map[string]bool{}
+	for _, o := range after {
+		tag, ok := prefixedTag(o, prefix)
+		if !ok {
+			continue
+		}
+		data, _ := json.Marshal(o)
+		if prev, ok := old[tag]; ok && prev == string(data) {
+			kept[tag] = true
+			continue
+		}
+		add = append(add, o)
+	}
+	for _, o := range before {
+		if tag, ok := prefixedTag(o, prefix); ok && !kept[tag] {
+			remove = append(remove, tag)
+		}
+	}
+	return remove, add
+}
+
+func prefixedTag(o interface{}, prefix string) (string, bool) {
+	ob, _ := o.(map[string]interface{})
+	tag, _ := ob["tag"].(string)
+	return tag, tag != "" && strings.HasPrefix(tag, prefix)
+}
+
+// hotApply applies the outbound changes to the running Xray. Removals go
+// first so that changed outbounds can be added back under the same tag.
+func hotApply(api xrayAPI, before, after []interface{}, prefix string) error {
+	remove, add := diffOutbounds(before, after, prefix)
+	if err := api.removeOutbounds(remove); err != nil {
+		return err
+	}
+	if err := api.addOutbounds(add); err != nil {
+		return err
+	}
+	stageLog("update").Info("hot-applied via Xray API", "server", api.Server, "removed", len(remove), "added", len(add))
+	return nil
+}
@@ -5,6 +5,7 @@ go 1.24.4
 require (
 	github.com/Ptechgithub/CloudflareScanner v0.0.0-20240410175413-6e02b8079a60
 	github.com/spf13/cobra v1.10.2
+	go.etcd.io/bbolt v1.4.3
 )
 
 require (
@@ -0,0 +1,219 @@
+// Package xuimock is a fake 3x-ui panel for tests. It implements the
+// endpoints cfscanner-to-3xui talks to, with the response shapes of a real
+// panel, and can be told to fail in the ways real panels and proxies do.
+package xuimock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Failure selects how an endpoint misbehaves.
+type Failure int
+
+const (
+	// OK answers normally.
+	OK Failure = iota
+	// SuccessFalse answers 200 with {"success":false}.
+	SuccessFalse
+	// EmptyBody answers 200 with no body.
+	EmptyBody
+	// NonJSON answers 200 with an HTML page, as a misrouted proxy would.
+	NonJSON
+	// BadGateway answers 502 with an HTML page.
+	BadGateway
+)
+
+// Server is a fake 3x-ui panel. Zero-value failure fields mean OK. Lock
+// Mu when reading or changing fields while requests may be in flight.
+type Server struct {
+	*httptest.Server
+
+	Mu       sync.Mutex
+	Username string
+	Password string
+	// BasePath is the panel web base path, e.g. "/secret"; empty serves at the root.
+	BasePath string
+	// CookieName is the session cookie name; empty means "3x-ui".
+	CookieName string
+	// TwoFactor, when set, enables 2FA: it checks the posted twoFactorCode.
+	TwoFactor func(code string) bool
+	// LoginSecret, when set, must be posted as loginSecret.
+	LoginSecret string
+
+	// XraySetting is the stored xray config, replaced by every update.
+	XraySetting map[string]interface{}
+
+	FailLogin   Failure
+	FailConfig  Failure
+	FailUpdate  Failure
+	FailRestart Failure
+	// FailTimes limits failures to the first N matching requests; 0 means always.
+	FailTimes int
+
+	Logins   int
+	Updates  int
+	Restarts int
+
+	sessions map[string]bool
+	failed   int
+}
+
+// New starts a panel accepting username/password, seeded with xraySetting.
+func New(username, password string, xraySetting map[string]interface{}) *Server {
+	s := &Server{
+		Username:    username,
+		Password:    password,
+		XraySetting: xraySetting,
+		sessions:    map[string]bool{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Outbounds returns the outbounds of the stored xray config.
+func (s *Server) Outbounds() []interface{} {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	obs, _ := s.XraySetting["outbounds"].([]interface{})
+	return obs
+}
+
+func (s *Server) cookieName() string {
+	if s.CookieName != "" {
+		return s.CookieName
+	}
+	return "3x-ui"
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	path := r.URL.Path
+	if s.BasePath != "" {
+		base := "/" + strings.Trim(s.BasePath, "/")
+		if !strings.HasPrefix(path, base+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		path = strings.TrimPrefix(path, base)
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch path {
+	case "/login":
+		s.login(w, r)
+	case "/getTwoFactorEnable":
+		writeJSON(w, true, "", s.TwoFactor != nil)
+	case "/getSecretStatus":
+		writeJSON(w, true, "", s.LoginSecret != "")
+	case "/panel/xray/":
+		if !s.authorized(w, r) || s.fail(w, s.FailConfig) {
+			return
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"xraySetting":     s.XraySetting,
+			"inboundTags":     []string{"inbound-443"},
+			"outboundTestUrl": "https://www.google.com/generate_204",
+		})
+		writeJSON(w, true, "", string(data))
+	case "/panel/xray/update":
+		if !s.authorized(w, r) || s.fail(w, s.FailUpdate) {
+			return
+		}
+		var setting map[string]interface{}
+		if err := json.Unmarshal([]byte(r.PostFormValue("xraySetting")), &setting); err != nil {
+			writeJSON(w, false, "Failed to save settings: "+err.Error(), nil)
+			return
+		}
+		s.XraySetting = setting
+		s.Updates++
+		writeJSON(w, true, "Settings saved successfully", nil)
+	case "/panel/api/server/restartXrayService":
+		if !s.authorized(w, r) || s.fail(w, s.FailRestart) {
+			return
+		}
+		s.Restarts++
+		writeJSON(w, true, "Xray service restarted", nil)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	if s.fail(w, s.FailLogin) {
+		return
+	}
+	if r.PostFormValue("username") != s.Username || r.PostFormValue("password") != s.Password {
+		writeJSON(w, false, "Invalid username or password.", nil)
+		return
+	}
+	if s.TwoFactor != nil && !s.TwoFactor(r.PostFormValue("twoFactorCode")) {
+		writeJSON(w, false, "Invalid two-factor code.", nil)
+		return
+	}
+	if s.LoginSecret != "" && r.PostFormValue("loginSecret") != s.LoginSecret {
+		writeJSON(w, false, "Invalid secret.", nil)
+		return
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	token := hex.EncodeToString(b)
+	s.sessions[token] = true
+	s.Logins++
+	http.SetCookie(w, &http.Cookie{Name: s.cookieName(), Value: token, Path: "/", HttpOnly: true})
+	writeJSON(w, true, "Login Successfully", nil)
+}
+
+// authorized checks the session cookie, answering like the panel's
+// checkLogin middleware does for XHR requests when it is missing.
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	c, err := r.Cookie(s.cookieName())
+	if err == nil && s.sessions[c.Value] {
+		return true
+	}
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "msg": "Your login session has expired. Please log in again.", "obj": nil})
+		return false
+	}
+	http.Redirect(w, r, "/"+strings.Trim(s.BasePath, "/"), http.StatusTemporaryRedirect)
+	return false
+}
+
+// fail writes the configured failure and reports whether it did.
+func (s *Server) fail(w http.ResponseWriter, f Failure) bool {
+	if f == OK || (s.FailTimes > 0 && s.failed >= s.FailTimes) {
+		return false
+	}
+	s.failed++
+	switch f {
+	case SuccessFalse:
+		writeJSON(w, false, "something went wrong", nil)
+	case EmptyBody:
+		w.WriteHeader(http.StatusOK)
+	case NonJSON:
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>Welcome to nginx!</body></html>"))
+	case BadGateway:
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("<html><body>502 Bad Gateway</body></html>"))
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, success bool, msg string, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"success": success, "msg": msg, "obj": obj})
+}